@@ -0,0 +1,77 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ByteSize is a number of bytes which is written in the config
+// with an optional unit, such as "500MB" or "2GiB"
+type ByteSize int64
+
+// byteUnits lists the units a ByteSize may be written in, largest first.
+// KB, MB, GB and TB are powers of 1000 while KiB, MiB, GiB and TiB are
+// powers of 1024.
+var byteUnits = []struct {
+	suffix string
+	size   ByteSize
+}{
+	{"TiB", 1 << 40},
+	{"GiB", 1 << 30},
+	{"MiB", 1 << 20},
+	{"KiB", 1 << 10},
+	{"TB", 1000 * 1000 * 1000 * 1000},
+	{"GB", 1000 * 1000 * 1000},
+	{"MB", 1000 * 1000},
+	{"KB", 1000},
+	{"B", 1},
+}
+
+// ParseByteSize parses a number of bytes with an optional unit suffix
+func ParseByteSize(s string) (ByteSize, error) {
+	trimmed := strings.TrimSpace(s)
+	unit := ByteSize(1)
+	for _, u := range byteUnits {
+		if strings.HasSuffix(strings.ToUpper(trimmed), strings.ToUpper(u.suffix)) {
+			trimmed = strings.TrimSpace(trimmed[:len(trimmed)-len(u.suffix)])
+			unit = u.size
+			break
+		}
+	}
+	value, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number of bytes such as 500MB or 2GiB", s)
+	}
+	return ByteSize(value * float64(unit)), nil
+}
+
+// String formats the size in the largest unit which represents it exactly
+func (b ByteSize) String() string {
+	for _, u := range byteUnits {
+		if b != 0 && b%u.size == 0 {
+			return fmt.Sprintf("%d%s", b/u.size, u.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", b)
+}
+
+// UnmarshalYAML reads a size written as a plain number of bytes
+// or with a unit suffix
+func (b *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(s)
+	if err != nil {
+		return err
+	}
+	*b = size
+	return nil
+}
+
+// MarshalYAML writes the size with its unit
+func (b ByteSize) MarshalYAML() (interface{}, error) {
+	return b.String(), nil
+}
@@ -0,0 +1,45 @@
+package config
+
+import (
+	log "github.com/sirupsen/logrus"
+)
+
+// UnmarshalYAML reads a TLS section, accepting the Enabled
+// spelling shipped in older example configs in place of Enable
+func (t *TLSStaticCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TLSStaticCfg
+	aliased := struct {
+		plain   `yaml:",inline"`
+		Enabled *bool `yaml:"Enabled"`
+	}{plain: plain(*t)}
+
+	if err := unmarshal(&aliased); err != nil {
+		return err
+	}
+	*t = TLSStaticCfg(aliased.plain)
+	if aliased.Enabled != nil {
+		log.Warn("The TLS Enabled setting is deprecated, rename it to Enable")
+		t.Enabled = *aliased.Enabled
+	}
+	return nil
+}
+
+// UnmarshalYAML reads a Zeek section, accepting the RotateLogs
+// spelling shipped in older example configs in place of Rotate
+func (z *ZeekCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ZeekCfg
+	aliased := struct {
+		plain      `yaml:",inline"`
+		RotateLogs *bool `yaml:"RotateLogs"`
+	}{plain: plain(*z)}
+
+	if err := unmarshal(&aliased); err != nil {
+		return err
+	}
+	*z = ZeekCfg(aliased.plain)
+	if aliased.RotateLogs != nil {
+		log.Warn("The Zeek RotateLogs setting is deprecated, rename it to Rotate")
+		z.RotateLogs = *aliased.RotateLogs
+	}
+	return nil
+}
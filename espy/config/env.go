@@ -0,0 +1,158 @@
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// envPrefix starts the name of every environment variable which overrides a setting
+const envPrefix = "ESPY"
+
+// redactedSecret replaces secrets when the config is printed
+const redactedSecret = "********"
+
+// applyEnvOverrides sets each config field from the environment variable
+// named after its path in the config file, with the yaml keys uppercased
+// and joined by underscores. For example, Redis.Password is set by
+// ESPY_REDIS_PASSWORD and the Hosts of the first entry in Outputs by
+// ESPY_OUTPUTS_0_ELASTICSEARCH_HOSTS. String values are used as is, while
+// other values are parsed as yaml, e.g. ESPY_REDIS_KEYS='["a", "b"]'.
+func applyEnvOverrides(reflected reflect.Value, prefix string, lookup func(string) (string, bool)) error {
+	for i := 0; i < reflected.NumField(); i++ {
+		f := reflected.Field(i)
+		name := yamlName(reflected.Type().Field(i))
+		if name == "-" {
+			continue
+		}
+		envName := prefix
+		if name != "" {
+			envName = prefix + "_" + strings.ToUpper(name)
+		}
+
+		if f.Kind() == reflect.Struct {
+			if err := applyEnvOverrides(f, envName, lookup); err != nil {
+				return err
+			}
+			continue
+		} else if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < f.Len(); j++ {
+				if err := applyEnvOverrides(f.Index(j), envName+"_"+strconv.Itoa(j), lookup); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		value, ok := lookup(envName)
+		if !ok || name == "" {
+			continue
+		}
+		if f.Kind() == reflect.String {
+			f.SetString(value)
+		} else if err := yaml.UnmarshalStrict([]byte(value), f.Addr().Interface()); err != nil {
+			return fmt.Errorf("invalid value in %s: %v", envName, err)
+		}
+		log.Infof("Using %s from the environment", envName)
+	}
+	return nil
+}
+
+// yamlName returns the key used for a struct field in the config file,
+// or an empty string if the field is inlined or not read from the file
+func yamlName(field reflect.StructField) string {
+	tag, ok := field.Tag.Lookup("yaml")
+	if !ok {
+		return ""
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" && strings.Contains(tag, ",inline") {
+		return ""
+	}
+	if name == "" {
+		return strings.ToLower(field.Name)
+	}
+	return name
+}
+
+// loadSecretFiles reads the value of each secret setting from the file
+// named by its File variant, such as Password from PasswordFile. This
+// allows secrets to be provided by Docker or Kubernetes secrets.
+func loadSecretFiles(reflected reflect.Value) error {
+	for i := 0; i < reflected.NumField(); i++ {
+		f := reflected.Field(i)
+		field := reflected.Type().Field(i)
+		if f.Kind() == reflect.Struct {
+			if err := loadSecretFiles(f); err != nil {
+				return err
+			}
+			continue
+		} else if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < f.Len(); j++ {
+				if err := loadSecretFiles(f.Index(j)); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		if field.Tag.Get("secret") != "true" {
+			continue
+		}
+		fileField, ok := reflected.Type().FieldByName(field.Name + "File")
+		if !ok {
+			continue
+		}
+		secretPath := reflected.FieldByIndex(fileField.Index).String()
+		if secretPath == "" {
+			continue
+		}
+		if f.String() != "" {
+			return fmt.Errorf("only one of %s and %s may be set", yamlName(field), yamlName(fileField))
+		}
+		contents, err := ioutil.ReadFile(filepath.Clean(secretPath))
+		if err != nil {
+			return fmt.Errorf("could not read %s: %v", yamlName(fileField), err)
+		}
+		f.SetString(strings.TrimRight(string(contents), "\r\n"))
+	}
+	return nil
+}
+
+// redactSecrets replaces the value of every non-empty secret setting.
+// Slices are copied before their elements are redacted so that the
+// original config is left untouched.
+func redactSecrets(reflected reflect.Value) {
+	for i := 0; i < reflected.NumField(); i++ {
+		f := reflected.Field(i)
+		if f.Kind() == reflect.Struct {
+			redactSecrets(f)
+		} else if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			copied := reflect.MakeSlice(f.Type(), f.Len(), f.Len())
+			reflect.Copy(copied, f)
+			for j := 0; j < copied.Len(); j++ {
+				redactSecrets(copied.Index(j))
+			}
+			f.Set(copied)
+		} else if f.Kind() == reflect.String && f.String() != "" &&
+			reflected.Type().Field(i).Tag.Get("secret") == "true" {
+			f.SetString(redactedSecret)
+		}
+	}
+}
+
+// String formats the config as yaml with every secret redacted
+func (s StaticCfg) String() string {
+	redactSecrets(reflect.ValueOf(&s).Elem())
+	out, err := yaml.Marshal(s)
+	if err != nil {
+		return err.Error()
+	}
+	return string(out)
+}
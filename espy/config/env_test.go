@@ -0,0 +1,96 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnvOverrides(t *testing.T) {
+	static := &StaticCfg{}
+	require.Nil(t, defaults.Set(static))
+	require.Nil(t, parseStaticConfig([]byte(`
+Outputs:
+  - Type: elasticsearch
+    Elasticsearch:
+      Hosts: ["127.0.0.1:9200"]
+`), static))
+
+	env := map[string]string{
+		"ESPY_REDIS_PASSWORD":                  "pa$$word",
+		"ESPY_REDIS_KEYS":                      `["net-data:sysmon", "net-data:dmz"]`,
+		"ESPY_REDIS_TLS_ENABLE":                "true",
+		"ESPY_LOGLEVEL":                        "5",
+		"ESPY_OUTPUTS_0_ELASTICSEARCH_TIMEOUT": "5s",
+	}
+	lookup := func(name string) (string, bool) {
+		value, ok := env[name]
+		return value, ok
+	}
+	require.Nil(t, applyEnvOverrides(reflect.ValueOf(static).Elem(), envPrefix, lookup))
+	require.Equal(t, "pa$$word", static.Redis.Password, "Strings should be used as is")
+	require.Equal(t, []string{"net-data:sysmon", "net-data:dmz"}, static.Redis.Keys)
+	require.True(t, static.Redis.TLS.Enabled)
+	require.Equal(t, 5, static.LogLevel)
+	require.Equal(t, 5*time.Second, static.Outputs[0].Elasticsearch.Timeout)
+
+	env = map[string]string{"ESPY_LOGLEVEL": "verbose"}
+	err := applyEnvOverrides(reflect.ValueOf(static).Elem(), envPrefix, lookup)
+	require.NotNil(t, err, "Invalid values should be rejected")
+	require.Contains(t, err.Error(), "ESPY_LOGLEVEL")
+}
+
+func TestSecretFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "espy-secrets")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	secretPath := filepath.Join(dir, "redis_password")
+	require.Nil(t, ioutil.WriteFile(secretPath, []byte("hunter2\n"), 0600))
+
+	static, err := parseTestConfig(t, `
+Redis:
+  PasswordFile: `+secretPath+`
+`)
+	require.Nil(t, err)
+	require.Equal(t, "hunter2", static.Redis.Password, "Trailing newlines should be trimmed")
+
+	_, err = parseTestConfig(t, `
+Redis:
+  Password: hunter2
+  PasswordFile: `+secretPath+`
+`)
+	require.NotNil(t, err, "Setting a secret and its file should be rejected")
+
+	_, err = parseTestConfig(t, `
+Redis:
+  PasswordFile: `+filepath.Join(dir, "missing")+`
+`)
+	require.NotNil(t, err, "Missing secret files should be reported")
+}
+
+func TestRedactSecrets(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Redis:
+  Password: hunter2
+Outputs:
+  - Type: elasticsearch
+    Elasticsearch:
+      Hosts: ["127.0.0.1:9200"]
+      APIKey: "id:secret-key"
+`)
+	require.Nil(t, err)
+
+	printed := static.String()
+	require.False(t, strings.Contains(printed, "hunter2"), "Passwords should be redacted")
+	require.False(t, strings.Contains(printed, "secret-key"), "API keys should be redacted")
+	require.Contains(t, printed, redactedSecret)
+	require.Equal(t, "hunter2", static.Redis.Password, "Printing should not modify the config")
+	require.Equal(t, "id:secret-key", static.Outputs[0].Elasticsearch.APIKey, "Printing should not modify the config")
+}
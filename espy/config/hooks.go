@@ -0,0 +1,73 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/creasty/defaults"
+)
+
+// Failure policies for rotation hooks
+const (
+	// HookFailureLog logs a hook which fails and carries on
+	HookFailureLog = "log"
+	// HookFailureStop shuts espy down when a hook fails
+	HookFailureStop = "stop"
+)
+
+// HookCfg configures a program or webhook which is
+// notified each time the Zeek logs are rotated
+type HookCfg struct {
+	Name string `yaml:"Name"`
+	// Command is the program to run followed by its arguments.
+	// The archive paths are appended to the arguments.
+	Command []string `yaml:"Command"`
+	// URL receives a JSON description of the rotation in a POST request
+	URL string `yaml:"URL"`
+	// Timeout bounds how long each attempt to run the hook may take
+	Timeout time.Duration `yaml:"Timeout" default:"5m"`
+	// Retries is the number of times a failed hook is tried again
+	Retries int `yaml:"Retries" default:"0"`
+	// RetryDelay is how long to wait before trying a failed hook again
+	RetryDelay time.Duration `yaml:"RetryDelay" default:"10s"`
+	// OnFailure is what to do once a hook has failed every attempt: log or stop
+	OnFailure string `yaml:"OnFailure" default:"log"`
+}
+
+// UnmarshalYAML fills in the default values for a hook before its
+// settings are read in, since defaults.Set cannot reach the
+// elements of the Hooks list before they exist
+func (h *HookCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain HookCfg
+	if err := defaults.Set(h); err != nil {
+		return err
+	}
+	return unmarshal((*plain)(h))
+}
+
+// checkHooks reports hooks which are missing settings or have invalid values
+func checkHooks(hooks []HookCfg) error {
+	for i := range hooks {
+		hook := &hooks[i]
+		if hook.Name == "" {
+			hook.Name = fmt.Sprintf("hook %d", i+1)
+		}
+		if (len(hook.Command) == 0) == (hook.URL == "") {
+			return fmt.Errorf("%s must set either a Command or a URL", hook.Name)
+		}
+		if hook.URL != "" {
+			parsed, err := url.Parse(hook.URL)
+			if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") {
+				return fmt.Errorf("%s: URL must be an http or https URL, got %q", hook.Name, hook.URL)
+			}
+		}
+		if hook.Timeout <= 0 || hook.Retries < 0 || hook.RetryDelay < 0 {
+			return fmt.Errorf("%s: Timeout must be positive and Retries and RetryDelay must not be negative", hook.Name)
+		}
+		if hook.OnFailure != HookFailureLog && hook.OnFailure != HookFailureStop {
+			return fmt.Errorf("%s: OnFailure must be %s or %s, got %q", hook.Name, HookFailureLog, HookFailureStop, hook.OnFailure)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"fmt"
+	"path/filepath"
+
+	"github.com/creasty/defaults"
+)
+
+// The output types built into espy
+const (
+	ElasticsearchOutputType = "elasticsearch"
+	ZeekOutputType          = "zeek"
+)
+
+type (
+	// OutputCfg configures a single output. Type selects the output plugin
+	// and the section of the same name holds its settings.
+	OutputCfg struct {
+		Type          string      `yaml:"Type"`
+		Name          string      `yaml:"Name"`
+		Elasticsearch ESStaticCfg `yaml:"Elasticsearch"`
+		Zeek          ZeekCfg     `yaml:"Zeek"`
+	}
+)
+
+// UnmarshalYAML fills in the default values for an output before
+// its settings are read in, since defaults.Set cannot reach
+// the elements of the Outputs list before they exist
+func (o *OutputCfg) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain OutputCfg
+	if err := defaults.Set(o); err != nil {
+		return err
+	}
+	return unmarshal((*plain)(o))
+}
+
+// initOutputs converts the legacy Elasticsearch and Zeek sections into
+// entries in the Outputs list if no outputs were explicitly configured,
+// then cleans up and checks the settings for every output
+func initOutputs(config *StaticCfg) error {
+	if len(config.Outputs) == 0 {
+		normalizeESConfig(&config.Elasticsearch)
+		if len(config.Elasticsearch.Hosts) != 0 {
+			config.Outputs = append(config.Outputs, OutputCfg{
+				Type:          ElasticsearchOutputType,
+				Elasticsearch: config.Elasticsearch,
+			})
+		}
+		config.Outputs = append(config.Outputs, OutputCfg{
+			Type: ZeekOutputType,
+			Zeek: config.Zeek,
+		})
+	}
+
+	names := make(map[string]bool, len(config.Outputs))
+	zeekPaths := make(map[string]string)
+	for i := range config.Outputs {
+		out := &config.Outputs[i]
+		if out.Type == "" {
+			return fmt.Errorf("output %d is missing a Type", i+1)
+		}
+		if out.Name == "" {
+			out.Name = out.Type
+		}
+		if names[out.Name] {
+			return fmt.Errorf("output name %q is used more than once, set a unique Name for each output", out.Name)
+		}
+		names[out.Name] = true
+
+		normalizeESConfig(&out.Elasticsearch)
+		out.Zeek.OutputPath = filepath.Clean(out.Zeek.OutputPath)
+
+		if out.Type == ZeekOutputType {
+			if other, ok := zeekPaths[out.Zeek.OutputPath]; ok {
+				return fmt.Errorf("outputs %q and %q both write Zeek logs to %s", other, out.Name, out.Zeek.OutputPath)
+			}
+			zeekPaths[out.Zeek.OutputPath] = out.Name
+		}
+	}
+	return nil
+}
+
+// normalizeESConfig folds the single Host setting into the Hosts list
+// and cleans the TLS file paths
+func normalizeESConfig(esCfg *ESStaticCfg) {
+	// the single Host setting is shorthand for a one element Hosts list
+	if esCfg.Host != "" {
+		esCfg.Hosts = append([]string{esCfg.Host}, esCfg.Hosts...)
+		esCfg.Host = ""
+	}
+	cleanTLSPaths(&esCfg.TLS)
+}
@@ -0,0 +1,97 @@
+package config
+
+import (
+	"testing"
+
+	"github.com/creasty/defaults"
+	"github.com/stretchr/testify/require"
+)
+
+func parseTestConfig(t *testing.T, contents string) (*StaticCfg, error) {
+	static := &StaticCfg{}
+	require.Nil(t, defaults.Set(static))
+	return static, parseStaticConfig([]byte(contents), static)
+}
+
+func TestLegacyOutputs(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Elasticsearch:
+  Host: "127.0.0.1:9200"
+Zeek:
+  Path: "/tmp/zeek/"
+`)
+	require.Nil(t, err)
+	require.Len(t, static.Outputs, 2)
+	require.Equal(t, ElasticsearchOutputType, static.Outputs[0].Name)
+	require.Equal(t, []string{"127.0.0.1:9200"}, static.Outputs[0].Elasticsearch.Hosts)
+	require.Equal(t, ZeekOutputType, static.Outputs[1].Name)
+	require.Equal(t, "/tmp/zeek", static.Outputs[1].Zeek.OutputPath)
+	require.True(t, static.Outputs[1].Zeek.RotateLogs)
+}
+
+func TestOutputsList(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Outputs:
+  - Type: zeek
+    Name: zeek-main
+  - Type: zeek
+    Name: zeek-dmz
+    Zeek:
+      Path: /opt/zeek/dmz
+      Rotate: false
+`)
+	require.Nil(t, err)
+	require.Len(t, static.Outputs, 2)
+	require.Equal(t, "/opt/zeek/logs", static.Outputs[0].Zeek.OutputPath, "Defaults should apply to each output")
+	require.True(t, static.Outputs[0].Zeek.RotateLogs)
+	require.Equal(t, "/opt/zeek/dmz", static.Outputs[1].Zeek.OutputPath)
+	require.False(t, static.Outputs[1].Zeek.RotateLogs)
+}
+
+func TestDuplicateOutputs(t *testing.T) {
+	_, err := parseTestConfig(t, `
+Outputs:
+  - Type: zeek
+  - Type: zeek
+    Zeek:
+      Path: /opt/zeek/dmz
+`)
+	require.NotNil(t, err, "Outputs without unique names should be rejected")
+
+	_, err = parseTestConfig(t, `
+Outputs:
+  - Type: zeek
+    Name: a
+  - Type: zeek
+    Name: b
+`)
+	require.NotNil(t, err, "Zeek outputs sharing a directory should be rejected")
+}
+
+func TestRoutingDefault(t *testing.T) {
+	rules := `
+Outputs:
+  - Type: zeek
+    Name: zeek-main
+  - Type: zeek
+    Name: zeek-dmz
+    Zeek:
+      Path: /opt/zeek/dmz
+Routing:
+  Rules:
+    - EventCodes: ["3"]
+      Outputs: ["zeek-dmz"]
+`
+	_, err := parseTestConfig(t, rules)
+	require.NotNil(t, err, "Rules without a default route should be rejected")
+	require.Contains(t, err.Error(), "DropUnmatched")
+
+	_, err = parseTestConfig(t, rules+"  DropUnmatched: true\n")
+	require.Nil(t, err)
+
+	_, err = parseTestConfig(t, rules+"  Default: [\"zeek-main\"]\n")
+	require.Nil(t, err)
+
+	_, err = parseTestConfig(t, rules+"  Default: [\"zeek-lab\"]\n")
+	require.NotNil(t, err, "Default routes to unknown outputs should be rejected")
+}
@@ -0,0 +1,49 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// PartitionCfg writes the events matching its criteria to a Zeek log
+// tree of their own, in a subdirectory of the output's Path named after
+// the partition
+type PartitionCfg struct {
+	Name     string `yaml:"Name"`
+	MatchCfg `yaml:",inline"`
+}
+
+// checkPartitions reports partitions which cannot be used as
+// directory names or which share a name
+func checkPartitions(zeekCfg ZeekCfg) error {
+	if len(zeekCfg.Partitions) == 0 {
+		return nil
+	}
+	names := make(map[string]bool, len(zeekCfg.Partitions))
+	for i := range zeekCfg.Partitions {
+		name := zeekCfg.Partitions[i].Name
+		if err := checkPartitionName(name); err != nil {
+			return fmt.Errorf("partition %d: %v", i+1, err)
+		}
+		if names[name] {
+			return fmt.Errorf("partition %q is listed twice", name)
+		}
+		names[name] = true
+	}
+	if err := checkPartitionName(zeekCfg.DefaultPartition); err != nil {
+		return fmt.Errorf("DefaultPartition: %v", err)
+	}
+	return nil
+}
+
+// checkPartitionName ensures a partition names a single directory
+// which does not clash with the spool directory
+func checkPartitionName(name string) error {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return fmt.Errorf("the name must be a directory name, got %q", name)
+	}
+	if name == "ecs-spool" {
+		return fmt.Errorf("the name %q is used for the spool directory", name)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package config
+
+import "fmt"
+
+type (
+	// RoutingCfg selects which outputs receive each event. If no rules
+	// are configured, every event is sent to every output.
+	RoutingCfg struct {
+		Rules []RouteCfg `yaml:"Rules"`
+		// Default lists the outputs which receive events matching none of the rules
+		Default []string `yaml:"Default"`
+		// DropUnmatched allows rules without a Default, dropping the
+		// events which match none of the rules
+		DropUnmatched bool `yaml:"DropUnmatched"`
+	}
+
+	// RouteCfg sends the events which match its criteria to a list of outputs.
+	// Rules are checked in order and an event is sent to the outputs of every
+	// rule it matches, up to and including the first matching rule marked Final.
+	RouteCfg struct {
+		Name     string `yaml:"Name"`
+		MatchCfg `yaml:",inline"`
+		Outputs  []string `yaml:"Outputs"`
+		Final    bool     `yaml:"Final"`
+	}
+
+	// MatchCfg describes a set of events. An event matches if it
+	// matches every criteria which is set. A criteria matches if any
+	// of its values match. Agent hostnames, agent IDs and Redis keys
+	// may contain shell style wildcards.
+	MatchCfg struct {
+		Providers      []string `yaml:"Providers"`
+		EventCodes     []string `yaml:"EventCodes"`
+		AgentHostnames []string `yaml:"AgentHostnames"`
+		AgentIDs       []string `yaml:"AgentIDs"`
+		Keys           []string `yaml:"Keys"`
+		// IPRanges holds CIDR ranges matched against the source,
+		// destination and host IPs of an event
+		IPRanges []string `yaml:"IPRanges"`
+		Tags     []string `yaml:"Tags"`
+	}
+)
+
+// checkRouting ensures the routing rules only refer to configured outputs
+// and that events matching none of the rules are not silently dropped
+func checkRouting(config *StaticCfg) error {
+	outputs := make(map[string]bool, len(config.Outputs))
+	for i := range config.Outputs {
+		outputs[config.Outputs[i].Name] = true
+	}
+
+	checkNames := func(names []string, section string) error {
+		for _, name := range names {
+			if !outputs[name] {
+				return fmt.Errorf("%s refers to unknown output %q", section, name)
+			}
+		}
+		return nil
+	}
+
+	for i, rule := range config.Routing.Rules {
+		section := fmt.Sprintf("routing rule %d", i+1)
+		if rule.Name != "" {
+			section = fmt.Sprintf("routing rule %q", rule.Name)
+		}
+		if err := checkNames(rule.Outputs, section); err != nil {
+			return err
+		}
+	}
+	if len(config.Routing.Rules) != 0 && len(config.Routing.Default) == 0 && !config.Routing.DropUnmatched {
+		return fmt.Errorf("routing rules require a Default route, or DropUnmatched to drop the events matching no rules")
+	}
+	return checkNames(config.Routing.Default, "default route")
+}
@@ -3,17 +3,18 @@ package config
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
+	"fmt"
 	"github.com/blang/semver"
 	log "github.com/sirupsen/logrus"
 	"io/ioutil"
-	"os"
 )
 
 type (
 	RunningCfg struct {
-		Redis         RedisRunningCfg
-		Elasticsearch ESRunningCfg
-		Version       semver.Version
+		Redis   RedisRunningCfg
+		Outputs []OutputRunningCfg
+		Version semver.Version
 	}
 
 	RedisRunningCfg struct {
@@ -23,20 +24,35 @@ type (
 	ESRunningCfg struct {
 		TLSConfig *tls.Config
 	}
+
+	// OutputRunningCfg holds the running config for the output
+	// at the same position in StaticCfg.Outputs
+	OutputRunningCfg struct {
+		Elasticsearch ESRunningCfg
+	}
 )
 
 // initRunningConfig uses data in the static config initialize
 // the passed in running config
 func initRunningConfig(static *StaticCfg, running *RunningCfg) error {
+	var err error
 	if static.Redis.TLS.Enabled {
-		running.Redis.TLSConfig = parseStaticTLSConfig(&static.Redis.TLS)
+		running.Redis.TLSConfig, err = parseStaticTLSConfig(&static.Redis.TLS)
+		if err != nil {
+			return err
+		}
 	}
 
-	if static.Elasticsearch.TLS.Enabled {
-		running.Elasticsearch.TLSConfig = parseStaticTLSConfig(&static.Elasticsearch.TLS)
+	running.Outputs = make([]OutputRunningCfg, len(static.Outputs))
+	for i := range static.Outputs {
+		if static.Outputs[i].Elasticsearch.TLS.Enabled {
+			running.Outputs[i].Elasticsearch.TLSConfig, err = parseStaticTLSConfig(&static.Outputs[i].Elasticsearch.TLS)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	var err error
 	running.Version, err = semver.ParseTolerant(static.Version)
 	if err != nil {
 		log.WithError(err).WithField("version", static.Version).Error(
@@ -46,24 +62,92 @@ func initRunningConfig(static *StaticCfg, running *RunningCfg) error {
 	return err
 }
 
+//tlsVersions maps the supported MinVersion settings to their tls package constants
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
 //parseStaticTLSConfig converts a TLSStaticCfg into a tls.Config for use
-//with the golang net packages. If a CA file cannot be read, the error is logged
-//and the system certificate pool is used instead.
-func parseStaticTLSConfig(staticTLS *TLSStaticCfg) *tls.Config {
-	tlsConf := &tls.Config{}
+//with the golang net packages. An error is returned if the CA bundle or
+//client certificate cannot be loaded or the TLS version or cipher suites
+//are unknown, rather than falling back to less secure defaults.
+func parseStaticTLSConfig(staticTLS *TLSStaticCfg) (*tls.Config, error) {
+	tlsConf := &tls.Config{
+		ServerName: staticTLS.ServerName,
+	}
 	if !staticTLS.VerifyCertificate {
 		tlsConf.InsecureSkipVerify = true
 	}
 
-	finfo, err := os.Stat(staticTLS.CAFile)
-	if err != nil && !finfo.IsDir() {
+	var ok bool
+	tlsConf.MinVersion, ok = tlsVersions[staticTLS.MinVersion]
+	if !ok {
+		return nil, fmt.Errorf("unsupported TLS MinVersion %q, use 1.0, 1.1, 1.2 or 1.3", staticTLS.MinVersion)
+	}
+
+	var err error
+	tlsConf.CipherSuites, err = parseCipherSuites(staticTLS.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+
+	// trust the given CA bundle instead of the system's CAs
+	if staticTLS.CAFile != "" {
 		pem, err := ioutil.ReadFile(staticTLS.CAFile)
 		if err != nil {
-			log.WithField("file", staticTLS.CAFile).WithError(err).Error("Could not read CA file")
+			return nil, fmt.Errorf("could not read TLS CA file: %v", err)
+		}
+		tlsConf.RootCAs = x509.NewCertPool()
+		if !tlsConf.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("TLS CA file %s does not contain any PEM encoded certificates", staticTLS.CAFile)
+		}
+	}
+
+	// present a client certificate for mutual TLS
+	if staticTLS.CertFile != "" || staticTLS.KeyFile != "" {
+		if staticTLS.CertFile == "" || staticTLS.KeyFile == "" {
+			return nil, errors.New("both CertFile and KeyFile must be set to use a TLS client certificate")
+		}
+		cert, err := tls.LoadX509KeyPair(staticTLS.CertFile, staticTLS.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load TLS client certificate %s: %v", staticTLS.CertFile, err)
+		}
+		tlsConf.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConf, nil
+}
+
+//parseCipherSuites converts cipher suite names, such as
+//TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, into their IDs. The cipher suites
+//apply to TLS 1.2 and below, since Go does not allow TLS 1.3 suites to be
+//configured. An empty list selects Go's default cipher suites.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+
+	secure := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		secure[suite.Name] = suite.ID
+	}
+	insecure := make(map[string]uint16)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecure[suite.Name] = suite.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		if id, ok := secure[name]; ok {
+			ids = append(ids, id)
+		} else if id, ok := insecure[name]; ok {
+			log.WithField("cipher", name).Warn("Using an insecure TLS cipher suite")
+			ids = append(ids, id)
 		} else {
-			tlsConf.RootCAs = x509.NewCertPool()
-			tlsConf.RootCAs.AppendCertsFromPEM(pem)
+			return nil, fmt.Errorf("unknown TLS cipher suite %q", name)
 		}
 	}
-	return tlsConf
+	return ids, nil
 }
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"crypto/tls"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSCAFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "espy-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	require.Nil(t, ioutil.WriteFile(caFile, caPEM, 0644))
+
+	static, err := parseTestConfig(t, `
+Redis:
+  TLS:
+    Enable: true
+    VerifyCertificate: true
+    CAFile: `+caFile+`
+    ServerName: example.com
+    MinVersion: 1.2
+`)
+	require.Nil(t, err)
+	tlsConf, err := parseStaticTLSConfig(&static.Redis.TLS)
+	require.Nil(t, err)
+	require.Equal(t, uint16(tls.VersionTLS12), tlsConf.MinVersion)
+
+	// the test server's certificate is only valid for example.com and localhost
+	client := http.Client{Transport: &http.Transport{TLSClientConfig: tlsConf}}
+	resp, err := client.Get(server.URL)
+	require.Nil(t, err, "The CA file should be trusted")
+	resp.Body.Close()
+}
+
+func TestTLSFileErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "espy-tls")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	notPEM := filepath.Join(dir, "ca.pem")
+	require.Nil(t, ioutil.WriteFile(notPEM, []byte("not a certificate"), 0644))
+
+	tlsCfg := TLSStaticCfg{MinVersion: "1.2", CAFile: filepath.Join(dir, "missing.pem")}
+	_, err = parseStaticTLSConfig(&tlsCfg)
+	require.NotNil(t, err, "A missing CA file should be an error")
+
+	tlsCfg.CAFile = notPEM
+	_, err = parseStaticTLSConfig(&tlsCfg)
+	require.NotNil(t, err, "A CA file without certificates should be an error")
+
+	tlsCfg.CAFile = ""
+	tlsCfg.CertFile = filepath.Join(dir, "missing.crt")
+	tlsCfg.KeyFile = filepath.Join(dir, "missing.key")
+	_, err = parseStaticTLSConfig(&tlsCfg)
+	require.NotNil(t, err, "A missing client certificate should be an error")
+}
+
+func TestTLSPolicy(t *testing.T) {
+	tlsCfg := TLSStaticCfg{
+		MinVersion:   "1.3",
+		CipherSuites: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+	}
+	tlsConf, err := parseStaticTLSConfig(&tlsCfg)
+	require.Nil(t, err)
+	require.Equal(t, uint16(tls.VersionTLS13), tlsConf.MinVersion)
+	require.Equal(t, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}, tlsConf.CipherSuites)
+
+	tlsCfg.MinVersion = "1.4"
+	_, err = parseStaticTLSConfig(&tlsCfg)
+	require.NotNil(t, err, "Unknown TLS versions should be rejected")
+
+	tlsCfg.MinVersion = "1.2"
+	tlsCfg.CipherSuites = []string{"TLS_MADE_UP"}
+	_, err = parseStaticTLSConfig(&tlsCfg)
+	require.NotNil(t, err, "Unknown cipher suites should be rejected")
+}
@@ -1,48 +1,161 @@
 package config
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
+	log "github.com/sirupsen/logrus"
 	yaml "gopkg.in/yaml.v2"
 )
 
 type (
 	//StaticCfg is the container for other static config sections
 	StaticCfg struct {
-		Redis         RedisStaticCfg `yaml:"Redis"`
-		Elasticsearch ESStaticCfg    `yaml:"Elasticsearch"`
-		Zeek          ZeekCfg        `yaml:"Zeek"`
-		LogLevel      int            `yaml:"LogLevel" default:"3"`
+		Redis RedisStaticCfg `yaml:"Redis"`
+		// Elasticsearch and Zeek are only used if Outputs is empty
+		Elasticsearch ESStaticCfg   `yaml:"Elasticsearch"`
+		Zeek          ZeekCfg       `yaml:"Zeek"`
+		Outputs       []OutputCfg   `yaml:"Outputs"`
+		Routing       RoutingCfg    `yaml:"Routing"`
+		Pipeline      PipelineCfg   `yaml:"Pipeline"`
+		Monitoring    MonitoringCfg `yaml:"Monitoring"`
+		LogLevel      int           `yaml:"LogLevel" default:"3"`
 		Version       string
 		ExactVersion  string
 	}
 
 	RedisStaticCfg struct {
-		Host     string       `yaml:"Host"`
-		User     string       `yaml:"User"`
-		Password string       `yaml:"Password"`
-		TLS      TLSStaticCfg `yaml:"TLS"`
+		Host         string       `yaml:"Host"`
+		User         string       `yaml:"User"`
+		Password     string       `yaml:"Password" secret:"true"`
+		PasswordFile string       `yaml:"PasswordFile"`
+		Keys         []string     `yaml:"Keys" default:"[\"net-data:sysmon\"]"`
+		TLS          TLSStaticCfg `yaml:"TLS"`
 	}
 
 	ESStaticCfg struct {
-		Host     string       `yaml:"Host"`
-		User     string       `yaml:"User"`
-		Password string       `yaml:"Password"`
-		TLS      TLSStaticCfg `yaml:"TLS"`
+		Host            string        `yaml:"Host"`
+		Hosts           []string      `yaml:"Hosts"`
+		Scheme          string        `yaml:"Scheme" default:"https"`
+		Timeout         time.Duration `yaml:"Timeout" default:"30s"`
+		DeadHostBackoff time.Duration `yaml:"DeadHostBackoff" default:"30s"`
+		// Retries is how many times a document is resent when Elasticsearch
+		// is throttling requests, waiting RetryBackoff before the first
+		// retry and doubling it each time
+		Retries         int            `yaml:"Retries" default:"5"`
+		RetryBackoff    time.Duration  `yaml:"RetryBackoff" default:"1s"`
+		User            string         `yaml:"User"`
+		Password        string         `yaml:"Password" secret:"true"`
+		PasswordFile    string         `yaml:"PasswordFile"`
+		APIKey          string         `yaml:"APIKey" secret:"true"`
+		APIKeyFile      string         `yaml:"APIKeyFile"`
+		BearerToken     string         `yaml:"BearerToken" secret:"true"`
+		BearerTokenFile string         `yaml:"BearerTokenFile"`
+		Index           string         `yaml:"Index" default:"sysmon"`
+		TLS             TLSStaticCfg   `yaml:"TLS"`
+		Bootstrap       ESBootstrapCfg `yaml:"Bootstrap"`
+	}
+
+	// ESBootstrapCfg controls the index template and lifecycle policy
+	// espy installs in Elasticsearch on startup
+	ESBootstrapCfg struct {
+		Enable        bool   `yaml:"Enable" default:"false"`
+		TemplateName  string `yaml:"TemplateName" default:"espy-sysmon"`
+		PolicyName    string `yaml:"PolicyName" default:"espy-sysmon"`
+		PolicyType    string `yaml:"PolicyType" default:"ilm"`
+		RetentionDays int    `yaml:"RetentionDays" default:"30"`
 	}
 
 	ZeekCfg struct {
 		OutputPath string `yaml:"Path" default:"/opt/zeek/logs"`
 		RotateLogs bool   `yaml:"Rotate" default:"true"`
+		// RotateInterval is how often the logs are rotated, aligned to midnight
+		// in the Timezone. Intervals longer than a day must be whole days.
+		RotateInterval time.Duration `yaml:"RotateInterval" default:"1h"`
+		// RotateSchedule is a cron expression, such as "*/15 * * * *" or
+		// "@daily", which overrides RotateInterval if set
+		RotateSchedule string `yaml:"RotateSchedule"`
+		// RotateSize rotates a log early once its spool file reaches
+		// this size. Zero disables size based rotation.
+		RotateSize ByteSize `yaml:"RotateSize"`
+		// RotateLines rotates a log early once its spool file holds
+		// this many entries. Zero disables line based rotation.
+		RotateLines int64 `yaml:"RotateLines"`
+		// CheckpointInterval archives the logs and starts them over this
+		// often when RotateLogs is off. Zero only archives them on shutdown.
+		CheckpointInterval time.Duration `yaml:"CheckpointInterval"`
+		// RetentionDays deletes the dated archive directories once they
+		// are more than this many days old. Zero keeps them forever.
+		RetentionDays int `yaml:"RetentionDays"`
+		// RetentionSize deletes the oldest dated archive directories while
+		// they take up more than this much space. Zero disables the limit.
+		RetentionSize ByteSize `yaml:"RetentionSize"`
+		// MinFreePercent deletes the oldest dated archive directories while
+		// less than this percentage of the disk is free. It is checked once
+		// for all the Partitions. Zero disables the limit.
+		MinFreePercent float64 `yaml:"MinFreePercent"`
+		// Compression is how archived logs are compressed: gzip, zstd or none
+		Compression string `yaml:"Compression" default:"gzip"`
+		// CompressionLevel trades speed for smaller archives. Zero selects
+		// the default level of the compression method.
+		CompressionLevel int `yaml:"CompressionLevel"`
+		// ArchiveName is a naming preset, zeekctl or zeekctl-nocolon, or a
+		// Go template for the path of each archive relative to OutputPath
+		ArchiveName string `yaml:"ArchiveName" default:"zeekctl"`
+		// Timezone is the time zone of the archive names, the #open and #close
+		// times and the rotation schedule: UTC, Local or an IANA name such as
+		// America/Denver. The host's time zone is used if it is empty.
+		Timezone string `yaml:"Timezone"`
+		// Hooks are notified of the archives written by each rotation
+		Hooks []HookCfg `yaml:"Hooks"`
+		// Partitions split the events between separate log trees under
+		// OutputPath. Each event goes to the first partition it matches.
+		Partitions []PartitionCfg `yaml:"Partitions"`
+		// DefaultPartition is the partition which receives the events
+		// matching none of the Partitions. It may name one of them.
+		DefaultPartition string `yaml:"DefaultPartition" default:"default"`
+	}
+
+	// PipelineCfg sizes the stages which decode events and hand them to the outputs
+	PipelineCfg struct {
+		// Decoders is the number of goroutines parsing events read from Redis
+		Decoders int `yaml:"Decoders" default:"4"`
+		// QueueSize is the number of events buffered between each stage and
+		// for each output before reading from Redis is paused
+		QueueSize int `yaml:"QueueSize" default:"1000"`
+		// BatchSize is the maximum number of queued events handed
+		// to an output in a single write
+		BatchSize int `yaml:"BatchSize" default:"100"`
+		// DrainTimeout bounds how long espy spends writing out queued events
+		// when shutting down before dropping them and closing the outputs
+		DrainTimeout time.Duration `yaml:"DrainTimeout" default:"20s"`
+	}
+
+	// MonitoringCfg configures the HTTP listener which exports espy's metrics
+	MonitoringCfg struct {
+		// Listen is the address to serve metrics on, such as ":9109".
+		// Metrics are not served if it is empty.
+		Listen string `yaml:"Listen"`
 	}
 
 	TLSStaticCfg struct {
 		Enabled           bool   `yaml:"Enable" default:"false"`
 		VerifyCertificate bool   `yaml:"VerifyCertificate" default:"false"`
 		CAFile            string `yaml:"CAFile" default:""`
+		CertFile          string `yaml:"CertFile" default:""`
+		KeyFile           string `yaml:"KeyFile" default:""`
+		// ServerName overrides the hostname the server's certificate is checked against
+		ServerName string `yaml:"ServerName" default:""`
+		// MinVersion is the lowest TLS version accepted: 1.0, 1.1, 1.2 or 1.3
+		MinVersion string `yaml:"MinVersion" default:"1.2"`
+		// CipherSuites restricts the cipher suites offered for TLS 1.2 and below
+		CipherSuites []string `yaml:"CipherSuites"`
 	}
 )
 
@@ -66,20 +179,41 @@ func readStaticConfigFile(cfgPath string) ([]byte, error) {
 // parseStaticConfig loads the yaml from cfgFile into the provided config struct.
 // It also fixes up misc values that need tweaking into the right format.
 func parseStaticConfig(cfgFile []byte, config *StaticCfg) error {
-	err := yaml.Unmarshal(cfgFile, config)
+	// reject unknown settings so typos don't go unnoticed
+	err := yaml.UnmarshalStrict(cfgFile, config)
 
 	if err != nil {
-		return err
+		return describeYAMLError(err)
 	}
 
 	// expand env variables, config is a pointer
 	// so we have to call elem on the reflect value
 	expandConfig(reflect.ValueOf(config).Elem())
 
+	// override settings from ESPY_ environment variables, which are
+	// used as is, and then read any secrets from files
+	if err := applyEnvOverrides(reflect.ValueOf(config).Elem(), envPrefix, os.LookupEnv); err != nil {
+		return err
+	}
+	if err := loadSecretFiles(reflect.ValueOf(config).Elem()); err != nil {
+		return err
+	}
+
 	// clean all filepaths
 	config.Zeek.OutputPath = filepath.Clean(config.Zeek.OutputPath)
-	config.Redis.TLS.CAFile = filepath.Clean(config.Redis.TLS.CAFile)
-	config.Elasticsearch.TLS.CAFile = filepath.Clean(config.Elasticsearch.TLS.CAFile)
+	cleanTLSPaths(&config.Redis.TLS)
+
+	if err := initOutputs(config); err != nil {
+		return err
+	}
+
+	if err := checkRouting(config); err != nil {
+		return err
+	}
+
+	if err := checkValues(config); err != nil {
+		return err
+	}
 
 	// grab the version constants set by the build process
 	config.Version = Version
@@ -88,6 +222,91 @@ func parseStaticConfig(cfgFile []byte, config *StaticCfg) error {
 	return nil
 }
 
+// unknownFieldPattern matches the errors yaml returns for unknown settings
+var unknownFieldPattern = regexp.MustCompile(`^(line \d+): field (\S+) not found in type \S+$`)
+
+// describeYAMLError rewrites the errors returned by strict yaml decoding
+// in terms of the config file rather than the Go types it is read into
+func describeYAMLError(err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+	problems := make([]string, len(typeErr.Errors))
+	for i, problem := range typeErr.Errors {
+		problems[i] = unknownFieldPattern.ReplaceAllString(problem, "$1: unknown setting $2, check its spelling and indentation")
+	}
+	return fmt.Errorf("invalid config file:\n  %s", strings.Join(problems, "\n  "))
+}
+
+// checkValues reports settings whose values are out of range
+func checkValues(config *StaticCfg) error {
+	if config.LogLevel < int(log.PanicLevel) || config.LogLevel > int(log.TraceLevel) {
+		return fmt.Errorf("LogLevel must be between %d and %d, got %d", log.PanicLevel, log.TraceLevel, config.LogLevel)
+	}
+	if len(config.Redis.Keys) == 0 {
+		return fmt.Errorf("Redis Keys must list at least one key")
+	}
+	if config.Pipeline.Decoders < 0 || config.Pipeline.QueueSize < 0 || config.Pipeline.BatchSize < 0 || config.Pipeline.DrainTimeout < 0 {
+		return fmt.Errorf("Pipeline settings must not be negative")
+	}
+	for i := range config.Outputs {
+		out := &config.Outputs[i]
+		if out.Type == ZeekOutputType {
+			zeekCfg := out.Zeek
+			if zeekCfg.RotateSize < 0 || zeekCfg.RotateLines < 0 || zeekCfg.CheckpointInterval < 0 {
+				return fmt.Errorf("output %q: RotateSize, RotateLines and CheckpointInterval must not be negative", out.Name)
+			}
+			if zeekCfg.RetentionDays < 0 || zeekCfg.RetentionSize < 0 {
+				return fmt.Errorf("output %q: RetentionDays and RetentionSize must not be negative", out.Name)
+			}
+			if zeekCfg.MinFreePercent < 0 || zeekCfg.MinFreePercent >= 100 {
+				return fmt.Errorf("output %q: MinFreePercent must be between 0 and 100, got %g", out.Name, zeekCfg.MinFreePercent)
+			}
+			if _, err := time.LoadLocation(zeekCfg.Timezone); zeekCfg.Timezone != "" && err != nil {
+				return fmt.Errorf("output %q: invalid Timezone %q: %v", out.Name, zeekCfg.Timezone, err)
+			}
+			if err := checkHooks(out.Zeek.Hooks); err != nil {
+				return fmt.Errorf("output %q: %v", out.Name, err)
+			}
+			if err := checkPartitions(zeekCfg); err != nil {
+				return fmt.Errorf("output %q: %v", out.Name, err)
+			}
+		}
+		if out.Type != ElasticsearchOutputType {
+			continue
+		}
+		esCfg := out.Elasticsearch
+		if esCfg.Scheme != "http" && esCfg.Scheme != "https" {
+			return fmt.Errorf("output %q: Scheme must be http or https, got %q", out.Name, esCfg.Scheme)
+		}
+		if esCfg.Bootstrap.Enable && esCfg.Bootstrap.PolicyType != "ilm" && esCfg.Bootstrap.PolicyType != "ism" {
+			return fmt.Errorf("output %q: Bootstrap PolicyType must be ilm or ism, got %q", out.Name, esCfg.Bootstrap.PolicyType)
+		}
+		if esCfg.Timeout < 0 || esCfg.DeadHostBackoff < 0 {
+			return fmt.Errorf("output %q: Timeout and DeadHostBackoff must not be negative", out.Name)
+		}
+		if esCfg.Retries < 0 || esCfg.RetryBackoff < 0 {
+			return fmt.Errorf("output %q: Retries and RetryBackoff must not be negative", out.Name)
+		}
+	}
+	return nil
+}
+
+// cleanTLSPaths cleans the CA and client certificate file paths in a TLS
+// config section, leaving them empty if they are unset
+func cleanTLSPaths(tlsCfg *TLSStaticCfg) {
+	if tlsCfg.CAFile != "" {
+		tlsCfg.CAFile = filepath.Clean(tlsCfg.CAFile)
+	}
+	if tlsCfg.CertFile != "" {
+		tlsCfg.CertFile = filepath.Clean(tlsCfg.CertFile)
+	}
+	if tlsCfg.KeyFile != "" {
+		tlsCfg.KeyFile = filepath.Clean(tlsCfg.KeyFile)
+	}
+}
+
 // expandConfig expands environment variables in config strings
 func expandConfig(reflected reflect.Value) {
 	for i := 0; i < reflected.NumField(); i++ {
@@ -95,6 +314,10 @@ func expandConfig(reflected reflect.Value) {
 		// process sub configs
 		if f.Kind() == reflect.Struct {
 			expandConfig(f)
+		} else if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < f.Len(); j++ {
+				expandConfig(f.Index(j))
+			}
 		} else if f.Kind() == reflect.String {
 			f.SetString(os.ExpandEnv(f.String()))
 		} else if f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String {
@@ -0,0 +1,168 @@
+package config
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownSetting(t *testing.T) {
+	_, err := parseTestConfig(t, `
+Redis:
+  Host: "127.0.0.1:6379"
+  Passwrd: "secret"
+`)
+	require.NotNil(t, err, "Unknown settings should be rejected")
+	require.Contains(t, err.Error(), "line 4: unknown setting Passwrd")
+}
+
+func TestDeprecatedAliases(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Redis:
+  TLS:
+    Enabled: true
+Zeek:
+  RotateLogs: false
+`)
+	require.Nil(t, err)
+	require.True(t, static.Redis.TLS.Enabled, "TLS Enabled should be read as Enable")
+	require.False(t, static.Zeek.RotateLogs, "Zeek RotateLogs should be read as Rotate")
+	require.False(t, static.Redis.TLS.VerifyCertificate, "Defaults should be kept for settings which are not set")
+	require.Equal(t, "/opt/zeek/logs", static.Zeek.OutputPath, "Defaults should be kept for settings which are not set")
+}
+
+func TestInvalidValues(t *testing.T) {
+	_, err := parseTestConfig(t, `LogLevel: 9`)
+	require.NotNil(t, err)
+
+	_, err = parseTestConfig(t, `
+Elasticsearch:
+  Host: "127.0.0.1:9200"
+  Scheme: ftp
+`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "Scheme must be http or https")
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  MinFreePercent: 100
+`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "MinFreePercent must be between 0 and 100")
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  Timezone: Mars/Olympus_Mons
+`)
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "invalid Timezone")
+}
+
+func TestShippedConfigs(t *testing.T) {
+	for _, path := range []string{"../etc/espy.yaml", "../etc/espy.docker.yaml"} {
+		contents, err := ioutil.ReadFile(path)
+		require.Nil(t, err)
+		_, err = parseTestConfig(t, string(contents))
+		require.Nil(t, err, "%s should be a valid config", path)
+	}
+}
+
+func TestByteSize(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Zeek:
+  RotateSize: 500MB
+  RotateLines: 1000000
+`)
+	require.Nil(t, err)
+	require.Equal(t, ByteSize(500*1000*1000), static.Zeek.RotateSize)
+	require.Equal(t, int64(1000000), static.Zeek.RotateLines)
+
+	for text, size := range map[string]ByteSize{
+		"1024":   1024,
+		"2GiB":   2 << 30,
+		"1.5 kb": 1500,
+		"10B":    10,
+	} {
+		parsed, err := ParseByteSize(text)
+		require.Nil(t, err, text)
+		require.Equal(t, size, parsed, text)
+	}
+	require.Equal(t, "2GiB", ByteSize(2<<30).String())
+	require.Equal(t, "500MB", ByteSize(500*1000*1000).String())
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  RotateSize: lots
+`)
+	require.NotNil(t, err)
+}
+
+func TestHooks(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Zeek:
+  Hooks:
+    - Command: ["rita", "import"]
+    - Name: notify
+      URL: "https://example.com/rotated"
+      Retries: 2
+      OnFailure: stop
+`)
+	require.Nil(t, err)
+	hooks := static.Outputs[0].Zeek.Hooks
+	require.Len(t, hooks, 2)
+	require.Equal(t, "hook 1", hooks[0].Name)
+	require.Equal(t, 5*time.Minute, hooks[0].Timeout, "Hooks should get default values")
+	require.Equal(t, HookFailureLog, hooks[0].OnFailure)
+	require.Equal(t, HookFailureStop, hooks[1].OnFailure)
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  Hooks:
+    - Command: ["rita", "import"]
+      URL: "https://example.com/rotated"
+`)
+	require.NotNil(t, err, "A hook should not run a command and a webhook")
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  Hooks:
+    - URL: "https://example.com/rotated"
+      OnFailure: retry
+`)
+	require.NotNil(t, err)
+}
+
+func TestPartitions(t *testing.T) {
+	static, err := parseTestConfig(t, `
+Zeek:
+  Partitions:
+    - Name: acme
+      AgentHostnames: ["acme-*"]
+    - Name: globex
+      Keys: ["net-data:globex"]
+`)
+	require.Nil(t, err)
+	partitions := static.Outputs[0].Zeek.Partitions
+	require.Len(t, partitions, 2)
+	require.Equal(t, []string{"acme-*"}, partitions[0].AgentHostnames)
+	require.Equal(t, "default", static.Outputs[0].Zeek.DefaultPartition)
+
+	for _, invalid := range []string{"", "../acme", "ecs-spool"} {
+		_, err = parseTestConfig(t, `
+Zeek:
+  Partitions:
+    - Name: "`+invalid+`"
+`)
+		require.NotNil(t, err, invalid)
+	}
+
+	_, err = parseTestConfig(t, `
+Zeek:
+  Partitions:
+    - Name: acme
+    - Name: acme
+`)
+	require.NotNil(t, err, "Partition names should be unique")
+}
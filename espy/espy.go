@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"os"
 	"os/signal"
+	"syscall"
 	"time"
+	// embed the time zone database for the Zeek Timezone setting
+	_ "time/tzdata"
 
 	"github.com/benbjohnson/clock"
 	"github.com/go-redis/redis/v8"
@@ -14,9 +16,12 @@ import (
 	"github.com/spf13/afero"
 
 	"github.com/activecm/espy/espy/config"
-	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
+	"github.com/activecm/espy/espy/monitor"
 	"github.com/activecm/espy/espy/output"
-	"github.com/activecm/espy/espy/output/zeek"
+	"github.com/activecm/espy/espy/pipeline"
+	// register the zeek output type
+	_ "github.com/activecm/espy/espy/output/zeek"
 )
 
 // command line flags
@@ -32,15 +37,27 @@ var (
 		false,
 		"Print the version and exit immediately",
 	)
+
+	checkConfigFlag = flag.Bool(
+		"check-config",
+		false,
+		"Validate the configuration file, test the connections to Redis and the outputs, and exit",
+	)
+
+	healthcheckFlag = flag.Bool(
+		"healthcheck",
+		false,
+		"Check whether the running Espy is ready and exit non-zero if it is not",
+	)
 )
 
 // linkContextToInterrupt creates a child context which is cancelled when
-// the program receives an interrupt
+// the program receives an interrupt or is terminated, such as by docker stop
 func linkContextToInterrupt(ctx context.Context) (context.Context, context.CancelFunc) {
 	ctx, cancelCtx := context.WithCancel(ctx)
 
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	go func() {
 		<-c
 		cancelCtx()
@@ -48,16 +65,6 @@ func linkContextToInterrupt(ctx context.Context) (context.Context, context.Cance
 	return ctx, cancelCtx
 }
 
-// isContextCancelled returns true if a context has been cancelled
-func isContextCancelled(ctx context.Context) bool {
-	select {
-	case <-ctx.Done():
-		return true
-	default:
-	}
-	return false
-}
-
 func main() {
 	// parse command line flags into globally defined options above
 	flag.Parse()
@@ -67,6 +74,16 @@ func main() {
 		return
 	}
 
+	if *checkConfigFlag {
+		checkConfig()
+		return
+	}
+
+	if *healthcheckFlag {
+		healthcheck()
+		return
+	}
+
 	log.Info("Welcome to Espy by Active Countermeasures!")
 	conf, err := config.LoadConfig(*configFlag)
 	if err != nil {
@@ -77,112 +94,130 @@ func main() {
 	// create context to coordinate async shutdown
 	ctx, ctxCancelFunc := linkContextToInterrupt(context.Background())
 
-	// set up Redis connection
-	redisClient := redis.NewClient(&redis.Options{
-		Addr:     conf.S.Redis.Host,
-		Username: conf.S.Redis.User,
-		Password: conf.S.Redis.Password,
-	})
-	if conf.R.Redis.TLSConfig != nil {
-		redisClient.Options().TLSConfig = conf.R.Redis.TLSConfig
+	source := pipeline.RedisSource{
+		Client:  newRedisClient(conf),
+		Keys:    conf.S.Redis.Keys,
+		Timeout: time.Second,
 	}
 
-	// set up Elasticsearch connection
-	var esWriter output.JSONWriter
-	if conf.S.Elasticsearch.Host != "" {
-		log.Infof("Enabling Elasticsearch output at %s", conf.S.Elasticsearch.Host)
-		esWriter = output.NewElasticWriter(conf.S.Elasticsearch, conf.R.Elasticsearch)
-	} else {
-		log.Info("Disabling Elasticsearch output")
+	// serve metrics and health checks if a monitoring address is set
+	var server *monitor.Server
+	if conf.S.Monitoring.Listen != "" {
+		if err := metrics.RegisterListLength(source.Keys, source.ListLength); err != nil {
+			log.WithError(err).Fatal("Could not register Redis metrics")
+		}
+		server, err = monitor.NewServer(conf.S.Monitoring)
+		if err != nil {
+			log.WithError(err).Fatal("Could not start the monitoring listener")
+		}
+		server.AddReadinessCheck("redis", source.Ping)
+		server.Start()
+		defer server.Shutdown(context.Background())
 	}
 
-	// set up zeek file writer
-	var zeekWriter output.ECSWriter
-	if conf.S.Zeek.RotateLogs {
-		zeekWriter, err = zeek.CreateRollingWritingSystem(
-			afero.NewOsFs(), clock.New(), conf.S.Zeek.OutputPath, ctxCancelFunc,
-		)
-	} else {
-		zeekWriter, err = zeek.CreateStandardWritingSystem(
-			afero.NewOsFs(), clock.New(), conf.S.Zeek.OutputPath,
-		)
+	// set up the outputs in the order they are configured
+	env := output.Environment{
+		Fs:        afero.NewOsFs(),
+		Clock:     clock.New(),
+		CrashFunc: ctxCancelFunc,
+	}
+	running := newOutputSet(env, server)
+	outputs, err := running.open(conf, nil)
+	if err != nil {
+		log.Error("Shutting down.")
+		return
 	}
 
+	router, err := output.NewRouter(conf.S.Routing, outputNames(conf))
 	if err != nil {
-		log.WithError(err).Error("Failed to initialize Zeek writer. Shutting down.")
+		log.WithError(err).Error("Failed to initialize routing rules. Shutting down.")
+		outputs.Close()
 		return
 	}
 
-	for !isContextCancelled(ctx) {
+	// read events from Redis until we're told to stop or Redis fails,
+	// reloading the configuration on SIGHUP
+	p := pipeline.New(source, outputs, router, conf.S.Pipeline)
+	go reloadOnHangup(ctx, p, running, conf, ctxCancelFunc)
+	err = p.Run(ctx)
+	log.Warn("Shutting down.")
+	ctxCancelFunc() // in case we got here via an error rather than exit signal
+	if err != nil {
+		log.WithError(err).Error("Stopped reading events.")
+	}
+}
 
-		//try to get more data to process
-		netMessage, err := redisClient.BLPop(ctx, time.Second, "net-data:sysmon" /*, "net-data:packetbeat"*/).Result()
+// healthcheck queries the readiness endpoint of the Espy instance using
+// the same configuration file and exits non-zero if it is not ready.
+// This is used as the Docker health check. The check passes if monitoring
+// is disabled so that configurations predating it are not marked unhealthy.
+func healthcheck() {
+	conf, err := config.LoadConfig(*configFlag)
+	if err != nil {
+		log.WithError(err).Fatal("Could not load configuration file")
+	}
+	if conf.S.Monitoring.Listen == "" {
+		log.Warn("Health checks are disabled, set Monitoring.Listen to enable them")
+		return
+	}
+	if err := monitor.Probe(conf.S.Monitoring, "/readyz"); err != nil {
+		log.WithError(err).Fatal("Health check failed")
+	}
+	log.Info("Espy is ready")
+}
 
-		if err == redis.Nil {
-			// Read timeout but no exit signal, keep polling Redis
-			log.WithError(err).Debug("Timed out while polling Redis for data.")
-			continue
-		} else if err != nil {
-			log.WithError(err).Error("Could not read data from Redis.")
-			break
-		}
+// newRedisClient sets up the Redis connection described by the config
+func newRedisClient(conf *config.Config) *redis.Client {
+	redisClient := redis.NewClient(&redis.Options{
+		Addr:     conf.S.Redis.Host,
+		Username: conf.S.Redis.User,
+		Password: conf.S.Redis.Password,
+	})
+	if conf.R.Redis.TLSConfig != nil {
+		redisClient.Options().TLSConfig = conf.R.Redis.TLSConfig
+	}
+	return redisClient
+}
 
-		// parse metadata to get the beats version
-		ecsMetadata := input.ECSMetadata{}
-		err = json.Unmarshal([]byte(netMessage[1]), &ecsMetadata)
-		if err != nil {
-			log.WithError(err).WithField("input", netMessage[1]).Error("Could not parse JSON log metadata.")
-			continue
-		}
+// checkConfig validates the configuration file and tests the connections
+// to Redis and the outputs without processing any events. It exits
+// non-zero if any check failed.
+func checkConfig() {
+	conf, err := config.LoadConfig(*configFlag)
+	if err != nil {
+		log.WithError(err).Fatal("Invalid configuration file")
+	}
+	log.Info("The configuration file is valid")
+	log.Infof("Using the configuration:\n%s", conf.S)
 
-		//send message to elasticsearch
-		if esWriter != nil {
-			err = esWriter.WriteECSRecords([]string{netMessage[1]}, ecsMetadata.Metadata.Version)
-			if err != nil {
-				log.WithError(err).WithField("input", netMessage[1]).Error("Could not connect to Elasticsearch.")
-			}
-		}
+	failed := false
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	err = newRedisClient(conf).Ping(ctx).Err()
+	cancel()
+	if err != nil {
+		log.WithError(err).Error("Could not connect to Redis")
+		failed = true
+	} else {
+		log.Info("Connected to Redis")
+	}
 
-		//parse data and send it to zeek writer
-		ecsData := input.ECSRecord{}
-		// Check if the beats version is v8.x
-		if ecsMetadata.Metadata.Version != "" && ecsMetadata.Metadata.Version[0] == '8' {
-			ecsDatav8 := input.ECSRecordv8{}
-			err = json.Unmarshal([]byte(netMessage[1]), &ecsDatav8)
-			if err != nil {
-				log.WithError(err).WithField("input", netMessage[1]).Error("Could not parse v8.x JSON data.")
-				continue
-			}
-			// Process the v8.x event and convert it to a regular ECSRecord
-			data, err := ecsDatav8.Process()
-			if err != nil {
-				log.WithError(err).WithField("input", netMessage[1]).Error(err)
-				continue
-			}
-			ecsData = *data
+	env := output.Environment{
+		Fs:        afero.NewOsFs(),
+		Clock:     clock.New(),
+		CrashFunc: func() {},
+	}
+	for i := range conf.S.Outputs {
+		entry := log.WithField("output", conf.S.Outputs[i].Name)
+		if err := output.Check(conf.S.Outputs[i], conf.R.Outputs[i], env); err != nil {
+			entry.WithError(err).Error("Output check failed")
+			failed = true
 		} else {
-			err = json.Unmarshal([]byte(netMessage[1]), &ecsData)
-			if err != nil {
-				log.WithError(err).WithField("input", netMessage[1]).Error("Could not parse JSON data.")
-				continue
-			}
-		}
-
-		err = zeekWriter.WriteECSRecords([]input.ECSRecord{ecsData})
-		if err != nil {
-			if err == input.ErrMalformedECSRecord {
-				log.WithError(err).WithField("input", netMessage[1]).Error("Could not read malformed ECS data")
-				continue
-			} else {
-				log.WithError(err).WithField("input", netMessage[1]).Error("Could not write Zeek data.")
-				break
-			}
+			entry.Info("Output check passed")
 		}
 	}
-	log.Warn("Shutting down.")
-	ctxCancelFunc() // in case we got here via an error rather than exit signal
-	err = zeekWriter.Close()
-	if err != nil {
-		log.WithError(err).Error("Error encountered while closing Zeek writer.")
+
+	if failed {
+		log.Fatal("The configuration check failed")
 	}
+	log.Info("The configuration check passed")
 }
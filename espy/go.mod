@@ -1,16 +1,37 @@
 module github.com/activecm/espy/espy
 
-go 1.14
+go 1.22
 
 require (
 	github.com/benbjohnson/clock v1.3.0
 	github.com/blang/semver v3.5.1+incompatible
 	github.com/creasty/defaults v1.5.1
 	github.com/go-redis/redis/v8 v8.0.0-beta.9
+	github.com/klauspost/compress v1.18.0
+	github.com/prometheus/client_golang v1.11.1
 	github.com/robfig/cron v1.2.0
 	github.com/sirupsen/logrus v1.6.0
 	github.com/spf13/afero v1.8.1
 	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v2 v2.3.0
+)
+
+require (
+	github.com/beorn7/perks v1.0.1 // indirect
+	github.com/cespare/xxhash/v2 v2.1.1 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/dgryski/go-rendezvous v0.0.0-20200823014737-9f7001d12a5f // indirect
+	github.com/golang/protobuf v1.4.3 // indirect
+	github.com/konsorten/go-windows-terminal-sequences v1.0.3 // indirect
+	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	github.com/prometheus/client_model v0.2.0 // indirect
+	github.com/prometheus/common v0.26.0 // indirect
+	github.com/prometheus/procfs v0.6.0 // indirect
+	go.opentelemetry.io/otel v0.11.0 // indirect
+	golang.org/x/exp v0.0.0-20200821190819-94841d0725da // indirect
 	golang.org/x/sys v0.0.0-20220224120231-95c6836cb0e7 // indirect
-	gopkg.in/yaml.v2 v2.2.7
+	golang.org/x/text v0.3.4 // indirect
+	google.golang.org/protobuf v1.26.0-rc.1 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
 )
@@ -0,0 +1,104 @@
+package input
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// rawECSEvent is the union of the fields read from v7.x and v8.x beats
+// events so every document only has to be unmarshalled once. Fields which
+// are named or typed differently between the versions shadow the fields
+// of the embedded ECSRecord.
+type rawECSEvent struct {
+	Metadata Metadata `json:"@metadata"`
+	ECSRecord
+
+	Agent struct {
+		Hostname string // v7.x
+		Name     string // v8.x
+		ID       string
+	}
+
+	Event struct {
+		Provider string
+		// Code is a number in v7.x and a string in v8.x
+		Code json.RawMessage
+	}
+
+	Winlog struct {
+		EventData EventDatav8 `json:"event_data"`
+	}
+}
+
+// Decoder parses JSON documents from beats into ECSEvents. A Decoder reuses
+// its buffers between calls, so it must not be shared between goroutines.
+type Decoder struct {
+	buf []byte
+	raw rawECSEvent
+}
+
+// Decode parses a JSON document read from the given Redis key in a single pass.
+// An error is returned if the document is not valid JSON. If only the ECS
+// fields cannot be interpreted, the event is still returned with RecordErr set
+// so outputs which forward the raw document can handle it.
+func (d *Decoder) Decode(key, raw string) (ECSEvent, error) {
+	event := ECSEvent{
+		Key: key,
+		Raw: raw,
+	}
+
+	d.buf = append(d.buf[:0], raw...)
+	d.raw = rawECSEvent{}
+	if err := json.Unmarshal(d.buf, &d.raw); err != nil {
+		return event, fmt.Errorf("could not parse JSON log metadata: %v", err)
+	}
+	event.Version = d.raw.Metadata.Version
+
+	eventCode := string(d.raw.Event.Code)
+	if unquoted, err := strconv.Unquote(eventCode); err == nil {
+		eventCode = unquoted
+	} else if eventCode == "null" {
+		eventCode = ""
+	}
+
+	// Check if the beats version is v8.x
+	if event.Version != "" && event.Version[0] == '8' {
+		ecsDatav8 := ECSRecordv8{
+			RFCTimestamp: d.raw.RFCTimestamp,
+			Host:         d.raw.Host,
+			Winlog:       d.raw.Winlog,
+			Tags:         d.raw.Tags,
+		}
+		ecsDatav8.Agent.Name = d.raw.Agent.Name
+		ecsDatav8.Agent.ID = d.raw.Agent.ID
+		ecsDatav8.Event.Provider = d.raw.Event.Provider
+		ecsDatav8.Event.Code = eventCode
+
+		// Process the v8.x event and convert it to a regular ECSRecord
+		data, err := ecsDatav8.Process()
+		if err != nil {
+			event.RecordErr = err
+			return event, nil
+		}
+		event.Record = *data
+		return event, nil
+	}
+
+	if eventCode != "" {
+		if _, err := strconv.ParseFloat(eventCode, 64); err != nil {
+			event.RecordErr = fmt.Errorf("could not parse JSON data: invalid event code %s", eventCode)
+			return event, nil
+		}
+	}
+
+	event.Record = d.raw.ECSRecord
+	event.Record.Agent.Hostname = d.raw.Agent.Hostname
+	event.Record.Agent.ID = d.raw.Agent.ID
+	event.Record.Event.Provider = d.raw.Event.Provider
+	event.Record.Event.Code = json.Number(eventCode)
+	// leave the timestamp unset if it is malformed so writers can reject the record
+	event.Record.Timestamp, _ = time.Parse(time.RFC3339Nano, event.Record.RFCTimestamp)
+	return event, nil
+}
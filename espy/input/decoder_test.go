@@ -0,0 +1,170 @@
+package input
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+const testEventv7 = `{
+	"@timestamp": "2022-02-14T16:17:18.123Z",
+	"@metadata": {"beat": "winlogbeat", "type": "_doc", "version": "7.10.0"},
+	"agent": {"hostname": "WORKSTATION1", "id": "0f34e1f5-2f5c-4f3b-9d6c-1e2c1b1b4a3e", "type": "winlogbeat", "version": "7.10.0"},
+	"host": {"ip": ["fe80::1", "10.0.0.5"], "name": "workstation1"},
+	"source": {"ip": "10.0.0.5", "port": 49812, "domain": "workstation1"},
+	"destination": {"ip": "93.184.216.34", "port": 443},
+	"network": {"transport": "tcp", "protocol": "https", "direction": "egress"},
+	"event": {"provider": "Microsoft-Windows-Sysmon", "code": 3, "kind": "event"},
+	"process": {"pid": 4242, "executable": "C:\\Windows\\explorer.exe"},
+	"tags": ["beats_input_codec_plain_applied"]
+}`
+
+const testEventv8 = `{
+	"@timestamp": "2023-03-01T10:00:00.000Z",
+	"@metadata": {"beat": "winlogbeat", "type": "_doc", "version": "8.6.2"},
+	"agent": {"name": "WORKSTATION2", "id": "5c2b8a8e-7d0e-4b4b-9a52-3c3d9b5f1e2a", "type": "winlogbeat", "version": "8.6.2"},
+	"host": {"ip": ["10.0.0.6"], "name": "workstation2"},
+	"event": {"provider": "Microsoft-Windows-Sysmon", "code": "3", "kind": "event"},
+	"winlog": {
+		"event_data": {
+			"SourceIp": "10.0.0.6",
+			"SourcePort": "50123",
+			"DestinationIp": "93.184.216.34",
+			"DestinationPort": "443",
+			"Protocol": "tcp",
+			"DestinationPortName": "https",
+			"UtcTime": "2023-03-01 09:59:59.875"
+		}
+	}
+}`
+
+func TestDecodev7(t *testing.T) {
+	var decoder Decoder
+	event, err := decoder.Decode("net-data:sysmon", testEventv7)
+	require.Nil(t, err)
+	require.Nil(t, event.RecordErr)
+	require.Equal(t, "7.10.0", event.Version)
+	require.Equal(t, "net-data:sysmon", event.Key)
+
+	record := event.Record
+	require.Equal(t, "WORKSTATION1", record.Agent.Hostname)
+	require.Equal(t, "0f34e1f5-2f5c-4f3b-9d6c-1e2c1b1b4a3e", record.Agent.ID)
+	require.Equal(t, "10.0.0.5", record.Source.IP)
+	require.Equal(t, json.Number("49812"), record.Source.Port)
+	require.Equal(t, json.Number("443"), record.Destination.Port)
+	require.Equal(t, json.Number("3"), record.Event.Code)
+	require.Equal(t, []string{"beats_input_codec_plain_applied"}, record.Tags)
+	require.Equal(t, time.Date(2022, 2, 14, 16, 17, 18, 123000000, time.UTC), record.Timestamp)
+
+	// the single pass decoder should agree with unmarshalling the record directly
+	legacy := ECSRecord{}
+	require.Nil(t, json.Unmarshal([]byte(testEventv7), &legacy))
+	legacy.Timestamp = record.Timestamp
+	require.Equal(t, legacy, record)
+}
+
+func TestDecodev8(t *testing.T) {
+	var decoder Decoder
+	event, err := decoder.Decode("net-data:sysmon", testEventv8)
+	require.Nil(t, err)
+	require.Nil(t, event.RecordErr)
+	require.Equal(t, "8.6.2", event.Version)
+
+	// the single pass decoder should agree with the v8.x conversion
+	legacyv8 := ECSRecordv8{}
+	require.Nil(t, json.Unmarshal([]byte(testEventv8), &legacyv8))
+	legacy, err := legacyv8.Process()
+	require.Nil(t, err)
+	require.Equal(t, *legacy, event.Record)
+	require.Equal(t, "WORKSTATION2", event.Record.Agent.Hostname)
+	require.Equal(t, time.Date(2023, 3, 1, 9, 59, 59, 875000000, time.UTC), event.Record.Timestamp)
+
+	// reusing the decoder must not leak fields between events
+	event, err = decoder.Decode("net-data:sysmon", testEventv7)
+	require.Nil(t, err)
+	require.Equal(t, "WORKSTATION1", event.Record.Agent.Hostname)
+	require.Equal(t, "7.10.0", event.Version)
+	require.Equal(t, []string{"beats_input_codec_plain_applied"}, event.Record.Tags)
+}
+
+func TestDecodeMalformed(t *testing.T) {
+	var decoder Decoder
+	_, err := decoder.Decode("net-data:sysmon", `{"@metadata": `)
+	require.NotNil(t, err, "Invalid JSON should be rejected")
+
+	event, err := decoder.Decode("net-data:sysmon", `{"@metadata": {"version": "8.6.2"}, "event": {"code": "abc"}}`)
+	require.Nil(t, err, "Events with readable metadata should be returned")
+	require.NotNil(t, event.RecordErr, "Events with bad ECS fields should be flagged")
+}
+
+// decodeTwoPass parses an event the way espy did before the Decoder
+// was introduced. It is kept to benchmark against.
+func decodeTwoPass(raw string) (ECSRecord, error) {
+	ecsMetadata := ECSMetadata{}
+	if err := json.Unmarshal([]byte(raw), &ecsMetadata); err != nil {
+		return ECSRecord{}, err
+	}
+	if ecsMetadata.Metadata.Version != "" && ecsMetadata.Metadata.Version[0] == '8' {
+		ecsDatav8 := ECSRecordv8{}
+		if err := json.Unmarshal([]byte(raw), &ecsDatav8); err != nil {
+			return ECSRecord{}, err
+		}
+		data, err := ecsDatav8.Process()
+		if err != nil {
+			return ECSRecord{}, err
+		}
+		return *data, nil
+	}
+	ecsData := ECSRecord{}
+	err := json.Unmarshal([]byte(raw), &ecsData)
+	return ecsData, err
+}
+
+func BenchmarkDecodeTwoPassv7(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		record, err := decodeTwoPass(testEventv7)
+		if err != nil {
+			b.Fatal(err)
+		}
+		// the Zeek writers used to parse the timestamp for every line
+		if _, err := time.Parse(time.RFC3339Nano, record.RFCTimestamp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodev7(b *testing.B) {
+	b.ReportAllocs()
+	var decoder Decoder
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.Decode("net-data:sysmon", testEventv7); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeTwoPassv8(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		record, err := decodeTwoPass(testEventv8)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := time.Parse(time.RFC3339Nano, record.RFCTimestamp); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodev8(b *testing.B) {
+	b.ReportAllocs()
+	var decoder Decoder
+	for i := 0; i < b.N; i++ {
+		if _, err := decoder.Decode("net-data:sysmon", testEventv8); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -30,6 +30,8 @@ type Answer struct {
 // ECSRecord is the union of Elastic comma schema fields used by *beats software
 type ECSRecord struct {
 	RFCTimestamp string `json:"@timestamp"`
+	// Timestamp holds RFCTimestamp once it has been parsed by a Decoder
+	Timestamp time.Time `json:"-"`
 	// Type string // Not supported by sysmon/ winlogbeat. Use with packetbeat.
 
 	Agent struct {
@@ -66,6 +68,20 @@ type ECSRecord struct {
 			Name string
 		}
 	}
+	Tags []string
+}
+
+// Time returns the time the event occurred at, parsing RFCTimestamp
+// if the record was not produced by a Decoder
+func (r *ECSRecord) Time() (time.Time, error) {
+	if !r.Timestamp.IsZero() {
+		return r.Timestamp, nil
+	}
+	goTime, err := time.Parse(time.RFC3339Nano, r.RFCTimestamp)
+	if err != nil {
+		return goTime, ErrMalformedECSRecord
+	}
+	return goTime, nil
 }
 
 type EventDatav8 struct {
@@ -101,20 +117,26 @@ type ECSRecordv8 struct {
 		Provider string
 		Code     string
 	}
+
+	Tags []string
 }
 
 // Processes a v8.x event log and converts it into an ECSRecord
 func (r *ECSRecordv8) Process() (*ECSRecord, error) {
 	newRecord := &ECSRecord{
 		Host: r.Host,
+		Tags: r.Tags,
 	}
 	// Timestamp
 	// Attempt to parse UtcTime in its expected format and replace @timestamp with it
 	utcTime, err := time.Parse("2006-01-02 15:04:05.999", r.Winlog.EventData.UtcTime)
 	if err != nil {
 		newRecord.RFCTimestamp = r.RFCTimestamp
+		// leave the timestamp unset if it is malformed so writers can reject the record
+		newRecord.Timestamp, _ = time.Parse(time.RFC3339Nano, r.RFCTimestamp)
 	} else {
 		newRecord.RFCTimestamp = utcTime.Format(time.RFC3339Nano)
+		newRecord.Timestamp = utcTime
 	}
 
 	// Agent
@@ -0,0 +1,24 @@
+package input
+
+// ECSEvent is a single event read from Redis in both its raw JSON
+// form and as a parsed ECSRecord
+type ECSEvent struct {
+	// Key is the Redis key the event was read from
+	Key string
+	// Raw is the JSON document as sent by beats
+	Raw string
+	// Version is the version of the beats software which sent the event
+	Version string
+	// Record holds the parsed ECS fields. It is only valid if RecordErr is nil.
+	Record ECSRecord
+	// RecordErr is set if the event's metadata could be read but
+	// its ECS fields could not be parsed
+	RecordErr error
+}
+
+// ParseECSEvent parses a JSON document read from the given Redis key.
+// Callers parsing many events should reuse a Decoder instead.
+func ParseECSEvent(key, raw string) (ECSEvent, error) {
+	var decoder Decoder
+	return decoder.Decode(key, raw)
+}
@@ -0,0 +1,199 @@
+// Package metrics holds the Prometheus collectors which describe
+// the health of the espy pipeline
+package metrics
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	log "github.com/sirupsen/logrus"
+)
+
+const namespace = "espy"
+
+// The stages at which an event may fail to parse
+const (
+	// StageJSON means the event is not a valid JSON document
+	StageJSON = "json"
+	// StageECS means the event's ECS fields could not be read
+	StageECS = "ecs"
+	// StageZeek means the event's ECS fields could not be formatted as a Zeek log entry
+	StageZeek = "zeek"
+)
+
+var (
+	// Registry holds every espy metric and is served by the monitoring listener
+	Registry = prometheus.NewRegistry()
+
+	// EventsRead counts the events popped off of each Redis list
+	EventsRead = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "redis",
+		Name:      "events_read_total",
+		Help:      "Number of events popped off of each Redis list.",
+	}, []string{"key"})
+
+	// ParseFailures counts the events which could not be parsed at each stage
+	ParseFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "parse_failures_total",
+		Help:      "Number of events which could not be parsed, by the stage at which parsing failed.",
+	}, []string{"stage"})
+
+	// EventsUnrouted counts the events which matched no routing rules
+	// and were dropped because there is no default route
+	EventsUnrouted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_unrouted_total",
+		Help:      "Number of events dropped because they matched no routing rules and there is no default route.",
+	})
+
+	// ZeekRecordsWritten counts the records written to each type of Zeek log
+	ZeekRecordsWritten = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "zeek",
+		Name:      "records_written_total",
+		Help:      "Number of records written to each type of Zeek log.",
+	}, []string{"path"})
+
+	// ESRequestDuration tracks how long requests to each Elasticsearch node take
+	ESRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "elasticsearch",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of requests sent to each Elasticsearch node.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host"})
+
+	// ESResponses counts the responses from each Elasticsearch node by status
+	// code. Requests which received no response are counted with the code "error".
+	ESResponses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "elasticsearch",
+		Name:      "responses_total",
+		Help:      "Number of responses from each Elasticsearch node by HTTP status code.",
+	}, []string{"host", "code"})
+
+	// ZeekArchiveDuration tracks how long each rotated Zeek log takes to compress
+	ZeekArchiveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "zeek",
+		Name:      "archive_duration_seconds",
+		Help:      "Time taken to compress and archive each rotated Zeek log.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900},
+	}, []string{"dir"})
+
+	// ZeekArchiveFailures counts the rotated Zeek logs which could not be archived
+	ZeekArchiveFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "zeek",
+		Name:      "archive_failures_total",
+		Help:      "Number of rotated Zeek logs which could not be compressed and archived.",
+	}, []string{"dir"})
+
+	// ZeekArchivesPending counts the rotated Zeek logs waiting to be archived
+	ZeekArchivesPending = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "zeek",
+		Name:      "archives_pending",
+		Help:      "Number of rotated Zeek logs waiting to be compressed and archived.",
+	}, []string{"dir"})
+
+	rotations = newRotationCollector()
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		EventsRead,
+		ParseFailures,
+		EventsUnrouted,
+		ZeekRecordsWritten,
+		ZeekArchiveDuration,
+		ZeekArchiveFailures,
+		ZeekArchivesPending,
+		ESRequestDuration,
+		ESResponses,
+		rotations,
+	)
+}
+
+// RegisterListLength exports the current length of each of the given
+// Redis lists. length is called for every key each time the metrics are scraped.
+func RegisterListLength(keys []string, length func(key string) (int64, error)) error {
+	return Registry.Register(&listLengthCollector{keys: keys, length: length})
+}
+
+// ZeekRotated records that the Zeek logs in the given directory
+// were successfully rotated at the given time
+func ZeekRotated(dir string, at time.Time) {
+	rotations.rotated(dir, at)
+}
+
+var listLengthDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "redis", "list_length"),
+	"Number of events waiting in each Redis list.",
+	[]string{"key"}, nil,
+)
+
+// listLengthCollector looks up the lengths of the Redis lists when scraped
+type listLengthCollector struct {
+	keys   []string
+	length func(key string) (int64, error)
+}
+
+func (c *listLengthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- listLengthDesc
+}
+
+func (c *listLengthCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, key := range c.keys {
+		length, err := c.length(key)
+		if err != nil {
+			log.WithError(err).WithField("key", key).Debug("Could not read the length of the Redis list.")
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(listLengthDesc, prometheus.GaugeValue, float64(length), key)
+	}
+}
+
+var rotationAgeDesc = prometheus.NewDesc(
+	prometheus.BuildFQName(namespace, "zeek", "seconds_since_rotation"),
+	"Seconds since the Zeek logs in each directory were last rotated, or since the writer started.",
+	[]string{"dir"}, nil,
+)
+
+// rotationCollector reports how long ago the Zeek logs were last rotated
+type rotationCollector struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last map[string]time.Time
+}
+
+func newRotationCollector() *rotationCollector {
+	return &rotationCollector{
+		now:  time.Now,
+		last: make(map[string]time.Time),
+	}
+}
+
+func (c *rotationCollector) rotated(dir string, at time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.last[dir] = at
+}
+
+func (c *rotationCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- rotationAgeDesc
+}
+
+func (c *rotationCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	now := c.now()
+	for dir, last := range c.last {
+		ch <- prometheus.MustNewConstMetric(rotationAgeDesc, prometheus.GaugeValue, now.Sub(last).Seconds(), dir)
+	}
+}
@@ -0,0 +1,49 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListLength(t *testing.T) {
+	collector := &listLengthCollector{
+		keys: []string{"net-data:sysmon", "net-data:down"},
+		length: func(key string) (int64, error) {
+			if key == "net-data:down" {
+				return 0, errors.New("connection refused")
+			}
+			return 42, nil
+		},
+	}
+
+	expected := `
+# HELP espy_redis_list_length Number of events waiting in each Redis list.
+# TYPE espy_redis_list_length gauge
+espy_redis_list_length{key="net-data:sysmon"} 42
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected))
+	require.Nil(t, err, "Lists which cannot be read should be left out")
+}
+
+func TestSecondsSinceRotation(t *testing.T) {
+	start := time.Date(2022, 2, 14, 16, 0, 0, 0, time.UTC)
+	collector := newRotationCollector()
+	collector.now = func() time.Time { return start.Add(90 * time.Second) }
+	collector.rotated("/opt/zeek/logs", start)
+
+	registry := prometheus.NewPedanticRegistry()
+	require.Nil(t, registry.Register(collector))
+
+	expected := `
+# HELP espy_zeek_seconds_since_rotation Seconds since the Zeek logs in each directory were last rotated, or since the writer started.
+# TYPE espy_zeek_seconds_since_rotation gauge
+espy_zeek_seconds_since_rotation{dir="/opt/zeek/logs"} 90
+`
+	require.Nil(t, testutil.GatherAndCompare(registry, strings.NewReader(expected)))
+}
@@ -0,0 +1,105 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// HealthReport is the JSON document returned by the health endpoints
+type HealthReport struct {
+	// Status is "ok" if every check passed and "failing" otherwise
+	Status string `json:"status"`
+	// Checks maps the name of each check to "ok" or the reason it failed
+	Checks map[string]string `json:"checks"`
+}
+
+// serveChecks runs the checks concurrently and reports the results,
+// responding with 503 Service Unavailable if any check fails
+func serveChecks(w http.ResponseWriter, r *http.Request, checks []namedCheck) {
+	ctx, cancel := context.WithTimeout(r.Context(), checkTimeout)
+	defer cancel()
+
+	results := make([]error, len(checks))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i] = checks[i].check(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	report := HealthReport{Status: "ok", Checks: make(map[string]string, len(checks))}
+	for i := range checks {
+		if results[i] != nil {
+			report.Status = "failing"
+			report.Checks[checks[i].name] = results[i].Error()
+			log.WithError(results[i]).WithField("check", checks[i].name).Warn("Health check failed.")
+		} else {
+			report.Checks[checks[i].name] = "ok"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if report.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// Probe queries a health endpoint of the espy instance using the given
+// monitoring config. An error describing the failing checks is returned
+// if the instance is unhealthy or cannot be reached.
+func Probe(cfg config.MonitoringCfg, endpoint string) error {
+	if cfg.Listen == "" {
+		return fmt.Errorf("the health checks are disabled, set Monitoring.Listen to enable them")
+	}
+	host, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	// the listener accepts connections on every interface if no host is set
+	if host == "" || net.ParseIP(host).IsUnspecified() {
+		host = "127.0.0.1"
+	}
+
+	client := http.Client{Timeout: checkTimeout + 5*time.Second}
+	resp, err := client.Get("http://" + net.JoinHostPort(host, port) + endpoint)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		report := HealthReport{}
+		if err := json.Unmarshal(body, &report); err != nil {
+			return fmt.Errorf("health check HTTP Error: %d", resp.StatusCode)
+		}
+		var failures []string
+		for name, result := range report.Checks {
+			if result != "ok" {
+				failures = append(failures, fmt.Sprintf("%s: %s", name, result))
+			}
+		}
+		sort.Strings(failures)
+		return fmt.Errorf("espy is unhealthy: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
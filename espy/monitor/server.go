@@ -0,0 +1,129 @@
+// Package monitor serves the HTTP endpoints used to watch over espy
+package monitor
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/metrics"
+)
+
+// checkTimeout bounds how long the health endpoints wait for the checks
+const checkTimeout = 10 * time.Second
+
+// Check returns an error describing why a component is unhealthy
+type Check func(ctx context.Context) error
+
+// namedCheck is a Check along with the name it is reported under
+type namedCheck struct {
+	name  string
+	check Check
+}
+
+// Server exports espy's Prometheus metrics and health checks over HTTP.
+// /healthz reports whether espy is alive, and /readyz additionally reports
+// whether it can currently read and write events.
+type Server struct {
+	listener net.Listener
+	server   *http.Server
+
+	mu        sync.Mutex
+	liveness  []namedCheck
+	readiness []namedCheck
+}
+
+// NewServer creates a Server listening on the configured address.
+// The listener is opened immediately so address errors are reported
+// on startup, but requests are not served until Start is called.
+func NewServer(cfg config.MonitoringCfg) (*Server, error) {
+	listener, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{listener: listener}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(metrics.Registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", s.serveLiveness)
+	mux.HandleFunc("/readyz", s.serveReadiness)
+	s.server = &http.Server{Handler: mux}
+	return s, nil
+}
+
+// AddLivenessCheck adds a check which fails if a component has stopped
+// working and espy must be restarted. Liveness checks are reported
+// by both /healthz and /readyz.
+func (s *Server) AddLivenessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness = append(s.liveness, namedCheck{name: name, check: check})
+}
+
+// AddReadinessCheck adds a check which fails if a component cannot
+// currently handle events, such as when a remote service is unreachable
+func (s *Server) AddReadinessCheck(name string, check Check) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.readiness = append(s.readiness, namedCheck{name: name, check: check})
+}
+
+// RemoveChecks removes the liveness and readiness checks with the given name
+func (s *Server) RemoveChecks(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.liveness = removeCheck(s.liveness, name)
+	s.readiness = removeCheck(s.readiness, name)
+}
+
+// removeCheck returns the checks without those with the given name
+func removeCheck(checks []namedCheck, name string) []namedCheck {
+	kept := checks[:0]
+	for i := range checks {
+		if checks[i].name != name {
+			kept = append(kept, checks[i])
+		}
+	}
+	return kept
+}
+
+// Addr returns the address the Server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Start serves requests in the background until Shutdown is called
+func (s *Server) Start() {
+	log.Infof("Serving metrics and health checks on http://%s", s.listener.Addr())
+	go func() {
+		if err := s.server.Serve(s.listener); err != nil && err != http.ErrServerClosed {
+			log.WithError(err).Error("Monitoring listener failed.")
+		}
+	}()
+}
+
+// Shutdown stops the Server, waiting for open requests to finish
+// until the context is cancelled
+func (s *Server) Shutdown(ctx context.Context) error {
+	return s.server.Shutdown(ctx)
+}
+
+func (s *Server) serveLiveness(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	checks := append([]namedCheck(nil), s.liveness...)
+	s.mu.Unlock()
+	serveChecks(w, r, checks)
+}
+
+func (s *Server) serveReadiness(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	checks := append(append([]namedCheck(nil), s.liveness...), s.readiness...)
+	s.mu.Unlock()
+	serveChecks(w, r, checks)
+}
@@ -0,0 +1,62 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/metrics"
+)
+
+func TestServeMetrics(t *testing.T) {
+	server, err := NewServer(config.MonitoringCfg{Listen: "127.0.0.1:0"})
+	require.Nil(t, err)
+	server.Start()
+	defer server.Shutdown(context.Background())
+
+	metrics.EventsRead.WithLabelValues("net-data:sysmon").Inc()
+
+	resp, err := http.Get("http://" + server.Addr().String() + "/metrics")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.Nil(t, err)
+	require.Contains(t, string(body), `espy_redis_events_read_total{key="net-data:sysmon"}`)
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	cfg := config.MonitoringCfg{Listen: "127.0.0.1:0"}
+	server, err := NewServer(cfg)
+	require.Nil(t, err)
+	server.AddLivenessCheck("zeek", func(ctx context.Context) error { return nil })
+	server.AddReadinessCheck("redis", func(ctx context.Context) error {
+		return errors.New("WRONGPASS invalid username-password pair")
+	})
+	server.Start()
+	defer server.Shutdown(context.Background())
+
+	cfg.Listen = server.Addr().String()
+	require.Nil(t, Probe(cfg, "/healthz"), "Failing readiness checks should not affect liveness")
+
+	err = Probe(cfg, "/readyz")
+	require.NotNil(t, err, "Failing readiness checks should be reported")
+	require.Contains(t, err.Error(), "redis: WRONGPASS")
+
+	resp, err := http.Get("http://" + cfg.Listen + "/readyz")
+	require.Nil(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+
+	report := HealthReport{}
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&report))
+	require.Equal(t, "failing", report.Status)
+	require.Equal(t, "ok", report.Checks["zeek"])
+}
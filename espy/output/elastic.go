@@ -1,77 +1,345 @@
 package output
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
 	log "github.com/sirupsen/logrus"
 )
 
+// errNodesFailed is returned when a request could not be sent to any node
+var errNodesFailed = errors.New("every Elasticsearch node failed")
+
 type ElasticWriter struct {
 	config.ESStaticCfg
 	httpClient http.Client
+	hosts      *esHostPool
+}
+
+func init() {
+	Register(config.ElasticsearchOutputType, newElasticOutput)
+	RegisterChecker(config.ElasticsearchOutputType, checkElasticOutput)
 }
 
-// NewElasticWriter returns a JSONWriter which sends JSON document to
-// an Elasticsearch index
-func NewElasticWriter(static config.ESStaticCfg, running config.ESRunningCfg) JSONWriter {
+// newElasticOutput creates an ElasticWriter for an elasticsearch entry in the Outputs list
+func newElasticOutput(static config.OutputCfg, running config.OutputRunningCfg, env Environment) (Output, error) {
+	return NewElasticWriter(static.Elasticsearch, running.Elasticsearch)
+}
+
+// checkElasticOutput connects to the Elasticsearch cluster with the configured
+// credentials. The index template and lifecycle policy are not installed.
+func checkElasticOutput(static config.OutputCfg, running config.OutputRunningCfg, env Environment) error {
+	esCfg := static.Elasticsearch
+	esCfg.Bootstrap.Enable = false
+	writer, err := NewElasticWriter(esCfg, running.Elasticsearch)
+	if err != nil {
+		return err
+	}
+	return writer.(HealthChecker).Ready(context.Background())
+}
+
+// NewElasticWriter returns an Output which sends JSON document to
+// an Elasticsearch index. If bootstrapping is enabled, the index template
+// and lifecycle policy are installed before the writer is returned.
+func NewElasticWriter(static config.ESStaticCfg, running config.ESRunningCfg) (Output, error) {
+	hosts, err := newESHostPool(static.Hosts, static.Scheme, static.DeadHostBackoff)
+	if err != nil {
+		return nil, err
+	}
+
 	writer := ElasticWriter{
 		ESStaticCfg: static,
+		hosts:       hosts,
 	}
+	writer.httpClient.Timeout = static.Timeout
 	if running.TLSConfig != nil {
 		writer.httpClient.Transport = &http.Transport{
 			TLSClientConfig: running.TLSConfig,
 		}
 	}
-	return writer
+
+	if static.Bootstrap.Enable {
+		if err := writer.bootstrap(); err != nil {
+			return nil, err
+		}
+	}
+	return writer, nil
 }
 
 // targetIndex returns the name of the index to insert documents into
 func (e ElasticWriter) targetIndex() string {
 	today := time.Now()
-	//TODO: Make this configurable
-	return fmt.Sprintf("sysmon-%s", today.Format("2006-01-02"))
+	return fmt.Sprintf("%s-%s", e.Index, today.Format("2006-01-02"))
 }
 
-// WriteECSRecords sends the outputData to Elasticsearch
-func (e ElasticWriter) WriteECSRecords(outputData []string, beatsVersion string) error {
-	targetIndex := e.targetIndex()
-	var esHostURL string
-	if beatsVersion[0] == '8' {
-		esHostURL = fmt.Sprintf("https://%s/winlogbeat-%s/_doc?pipeline=winlogbeat-%s-routing", e.Host, beatsVersion, beatsVersion)
-	} else if beatsVersion == "7.17.9" {
-		esHostURL = fmt.Sprintf("https://%s/winlogbeat-%s/_doc", e.Host, beatsVersion)
-	} else { // beats version below 7.17.9
-		esHostURL = fmt.Sprintf("https://%s/%s/_doc", e.Host, targetIndex)
+// newRequest creates an authenticated HTTP request against the given
+// path on an Elasticsearch node
+func (e ElasticWriter) newRequest(ctx context.Context, method string, host *esHost, path string, body []byte) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, host.baseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case e.APIKey != "":
+		request.Header.Set("Authorization", "ApiKey "+encodeAPIKey(e.APIKey))
+	case e.BearerToken != "":
+		request.Header.Set("Authorization", "Bearer "+e.BearerToken)
+	default:
+		request.SetBasicAuth(e.User, e.Password)
+	}
+	request.Header.Set("Content-Type", "application/json")
+	return request, nil
+}
+
+// encodeAPIKey accepts an Elasticsearch API key either as the "id:api_key"
+// pair or in the base64 encoded form returned by the create API key endpoint
+func encodeAPIKey(apiKey string) string {
+	if strings.Contains(apiKey, ":") {
+		return base64.StdEncoding.EncodeToString([]byte(apiKey))
 	}
-	for i := range outputData {
-		reader := strings.NewReader(outputData[i])
-		request, err := http.NewRequest("POST", esHostURL, reader)
+	return apiKey
+}
+
+// credentials describes the credentials used to authenticate with
+// Elasticsearch without revealing any secrets
+func (e ElasticWriter) credentials() string {
+	switch {
+	case e.APIKey != "":
+		if id := strings.SplitN(e.APIKey, ":", 2); len(id) == 2 {
+			return fmt.Sprintf("API key %q", id[0])
+		}
+		return "API key"
+	case e.BearerToken != "":
+		return "bearer token"
+	default:
+		return fmt.Sprintf("user %q", e.User)
+	}
+}
+
+// isNodeFailure returns true if an HTTP status code indicates that the
+// Elasticsearch node, rather than the request, is at fault
+func isNodeFailure(statusCode int) bool {
+	return statusCode == http.StatusBadGateway ||
+		statusCode == http.StatusServiceUnavailable ||
+		statusCode == http.StatusGatewayTimeout
+}
+
+// do sends a request to the Elasticsearch cluster, failing over to the next
+// node when a node cannot be reached or reports that it is unavailable.
+// The request is abandoned once the context is done. The caller is
+// responsible for closing the response body.
+func (e ElasticWriter) do(ctx context.Context, method, path string, body []byte) (*http.Response, error) {
+	return e.send(ctx, method, path, body, true)
+}
+
+// send makes a request like do, giving up once the context is done. If
+// trackHealth is set, failed nodes are taken out of rotation and the nodes
+// which are backing off are not tried. Otherwise, as for health checks, every
+// node is tried and where events are sent is not affected.
+func (e ElasticWriter) send(ctx context.Context, method, path string, body []byte, trackHealth bool) (*http.Response, error) {
+	var hosts []*esHost
+	if trackHealth {
+		hosts = e.hosts.available(time.Now())
+	} else {
+		hosts = e.hosts.candidates(time.Now())
+	}
+	lastErr := errors.New("every node is backing off after failing")
+	for _, host := range hosts {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		request, err := e.newRequest(ctx, method, host, path, body)
 		if err != nil {
-			log.WithError(err).WithField("input", outputData[i]).Error("Could not create HTTP request to handoff data to Elasticsearch.")
+			return nil, err
 		}
-		request.SetBasicAuth(e.User, e.Password)
-		request.Header.Set("Content-Type", "application/json")
+
+		start := time.Now()
 		resp, err := e.httpClient.Do(request)
-		if err == nil && (resp == nil || resp.StatusCode < 200 || resp.StatusCode > 299) {
-			httpCode := -1
-			if resp != nil {
-				httpCode = resp.StatusCode
+		metrics.ESRequestDuration.WithLabelValues(host.baseURL).Observe(time.Since(start).Seconds())
+		if err != nil {
+			metrics.ESResponses.WithLabelValues(host.baseURL, "error").Inc()
+		} else {
+			metrics.ESResponses.WithLabelValues(host.baseURL, strconv.Itoa(resp.StatusCode)).Inc()
+		}
+
+		if err == nil && !isNodeFailure(resp.StatusCode) {
+			if trackHealth {
+				e.hosts.markHealthy(host)
 			}
-			err = fmt.Errorf("elasticsearch HTTP Error: %d", httpCode)
+			return resp, nil
 		}
-		if err != nil {
-			return err
+
+		if err == nil {
+			err = fmt.Errorf("elasticsearch HTTP Error: %d", resp.StatusCode)
+			resp.Body.Close()
+		}
+		lastErr = err
+		if !trackHealth {
+			log.WithError(err).WithField("host", host.baseURL).Debug("Elasticsearch node failed the health check.")
+			continue
 		}
-		log.Debugf("[%d] OK Data transferred to Elasticsearch: %s", resp.StatusCode, targetIndex)
-		resp.Body.Close()
+		log.WithError(err).WithField("host", host.baseURL).Warn("Elasticsearch node failed, trying the next node.")
+		e.hosts.markFailed(host, time.Now())
+	}
+	return nil, fmt.Errorf("%w: %v", errNodesFailed, lastErr)
+}
+
+// Alive always succeeds since the ElasticWriter fails over between
+// nodes rather than giving up
+func (e ElasticWriter) Alive(ctx context.Context) error {
+	return nil
+}
+
+// Ready returns an error if no Elasticsearch node accepts requests with
+// the configured credentials. Requests are bounded by the configured Timeout
+// and by the context. The nodes which fail are not taken out of rotation.
+func (e ElasticWriter) Ready(ctx context.Context) error {
+	resp, err := e.send(ctx, "GET", "/", nil, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("elasticsearch HTTP Error: %d: %s", resp.StatusCode, esErrorReason(respBody))
 	}
 	return nil
 }
 
+// WriteECSEvents sends the raw JSON documents to Elasticsearch. A document
+// which cannot be written does not stop the rest of the batch from being
+// sent. Documents are resent while Elasticsearch is throttling requests,
+// up to the configured number of Retries. Once a document runs out of
+// retries, the rest of the batch is only tried once so a throttling cluster
+// does not hold up the pipeline for every document in the batch. While every
+// node is failing, writing waits for a node to come back, which slows reading
+// from Redis rather than dropping events. Once the context is cancelled,
+// the documents which were not written are given up on.
+func (e ElasticWriter) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	retries := e.Retries
+	failed := 0
+	var lastErr error
+	for i := range events {
+		if ctx.Err() != nil {
+			failed += len(events) - i
+			lastErr = ctx.Err()
+			break
+		}
+		retryable, err := e.writeDocumentWithRetries(ctx, events[i].Raw, events[i].Version, retries)
+		if err == nil {
+			continue
+		}
+		if retryable {
+			retries = 0
+		}
+		failed++
+		lastErr = err
+		if len(events) > 1 {
+			log.WithError(err).WithField("input", events[i].Raw).Error("Could not write event to Elasticsearch.")
+		}
+	}
+	if failed == 0 {
+		return nil
+	}
+	if len(events) == 1 {
+		return lastErr
+	}
+	return fmt.Errorf("%d of %d documents could not be written: %v", failed, len(events), lastErr)
+}
+
+// writeDocumentWithRetries sends a document, resending it after a backoff
+// while the failure is temporary. Whether the last failure was temporary
+// is returned along with the error. If every node failed, the document is
+// resent once a node comes out of its backoff, however long that takes.
+// Waiting stops once the context is done.
+func (e ElasticWriter) writeDocumentWithRetries(ctx context.Context, document string, beatsVersion string, retries int) (bool, error) {
+	backoff := e.RetryBackoff
+	for attempt := 0; ; {
+		retryable, err := e.writeDocument(ctx, document, beatsVersion)
+		if err == nil || !retryable || ctx.Err() != nil {
+			return retryable, err
+		}
+
+		if errors.Is(err, errNodesFailed) {
+			wait := e.hosts.untilAvailable(time.Now())
+			if wait < e.RetryBackoff {
+				wait = e.RetryBackoff
+			}
+			log.WithError(err).Warnf("Could not write event to Elasticsearch, waiting %s for a node to recover.", wait)
+			if err := sleepContext(ctx, wait); err != nil {
+				return true, err
+			}
+			continue
+		}
+
+		if attempt >= retries {
+			return retryable, err
+		}
+		attempt++
+		log.WithError(err).Warnf("Could not write event to Elasticsearch, retrying in %s.", backoff)
+		if err := sleepContext(ctx, backoff); err != nil {
+			return true, err
+		}
+		backoff *= 2
+	}
+}
+
+// sleepContext waits for the given duration or until the context is done,
+// in which case the context's error is returned
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// isThrottled returns true if an HTTP status code indicates that
+// Elasticsearch cannot keep up and the request should be sent again later
+func isThrottled(statusCode int) bool {
+	return statusCode == http.StatusTooManyRequests
+}
+
+// writeDocument sends a single JSON document to the index matching the
+// version of beats which produced it. The returned bool is true if the
+// failure is temporary and the document should be sent again.
+func (e ElasticWriter) writeDocument(ctx context.Context, document string, beatsVersion string) (bool, error) {
+	targetIndex := e.targetIndex()
+	var esPath string
+	if strings.HasPrefix(beatsVersion, "8") {
+		esPath = fmt.Sprintf("/winlogbeat-%s/_doc?pipeline=winlogbeat-%s-routing", beatsVersion, beatsVersion)
+	} else if beatsVersion == "7.17.9" {
+		esPath = fmt.Sprintf("/winlogbeat-%s/_doc", beatsVersion)
+	} else { // beats version below 7.17.9
+		esPath = fmt.Sprintf("/%s/_doc", targetIndex)
+	}
+	resp, err := e.do(ctx, "POST", esPath, []byte(document))
+	if err != nil {
+		// every node failed or the write was cancelled
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return isThrottled(resp.StatusCode), fmt.Errorf("elasticsearch HTTP Error: %d", resp.StatusCode)
+	}
+	log.Debugf("[%d] OK Data transferred to Elasticsearch: %s", resp.StatusCode, targetIndex)
+	return false, nil
+}
+
 // Close does nothing for the ElasticWriter since each document is written
 // with its own TCP session. This will likely be needed if we implement the Bulk API.
 func (e ElasticWriter) Close() error {
@@ -0,0 +1,336 @@
+package output
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// esMappings describes the fields of the Sysmon ECS documents espy forwards
+// to Elasticsearch. Any other string fields are mapped as keywords rather than
+// falling back to Elasticsearch's text/keyword dynamic mapping.
+const esMappings = `{
+	"dynamic_templates": [
+		{
+			"strings_as_keyword": {
+				"match_mapping_type": "string",
+				"mapping": {"type": "keyword", "ignore_above": 1024}
+			}
+		}
+	],
+	"properties": {
+		"@timestamp": {"type": "date"},
+		"agent": {
+			"properties": {
+				"hostname": {"type": "keyword"},
+				"name": {"type": "keyword"},
+				"id": {"type": "keyword"},
+				"version": {"type": "keyword"}
+			}
+		},
+		"host": {
+			"properties": {
+				"ip": {"type": "ip"},
+				"name": {"type": "keyword"}
+			}
+		},
+		"source": {
+			"properties": {
+				"ip": {"type": "ip"},
+				"port": {"type": "long"}
+			}
+		},
+		"destination": {
+			"properties": {
+				"ip": {"type": "ip"},
+				"port": {"type": "long"}
+			}
+		},
+		"network": {
+			"properties": {
+				"transport": {"type": "keyword"},
+				"protocol": {"type": "keyword"}
+			}
+		},
+		"event": {
+			"properties": {
+				"provider": {"type": "keyword"},
+				"code": {"type": "keyword"}
+			}
+		},
+		"dns": {
+			"properties": {
+				"question": {
+					"properties": {
+						"name": {"type": "keyword"}
+					}
+				},
+				"answers": {
+					"properties": {
+						"type": {"type": "keyword"},
+						"data": {"type": "keyword"}
+					}
+				}
+			}
+		}
+	}
+}`
+
+// esPermissionError formats the error returned when Elasticsearch refuses
+// a bootstrap request because of the configured credentials
+type esPermissionError struct {
+	credentials string
+	action      string
+	privilege   string
+	status      int
+	reason      string
+}
+
+func (e esPermissionError) Error() string {
+	if e.status == http.StatusUnauthorized {
+		return fmt.Sprintf(
+			"elasticsearch rejected the %s while trying to %s: %s",
+			e.credentials, e.action, e.reason,
+		)
+	}
+	return fmt.Sprintf(
+		"elasticsearch %s lacks permission to %s (the %s privilege is required): %s",
+		e.credentials, e.action, e.privilege, e.reason,
+	)
+}
+
+// bootstrap idempotently installs the lifecycle policy and index template
+// for the configured index into Elasticsearch. The winlogbeat-<version>
+// indices used for newer beats are left to Winlogbeat's own templates,
+// which a higher priority template here would replace.
+func (e ElasticWriter) bootstrap() error {
+	indexPattern := e.Index + "-*"
+	bootstrapCfg := e.Bootstrap
+
+	var templateSettings map[string]interface{}
+	if bootstrapCfg.RetentionDays > 0 {
+		switch bootstrapCfg.PolicyType {
+		case "ilm":
+			if err := e.putILMPolicy(); err != nil {
+				return err
+			}
+			templateSettings = map[string]interface{}{
+				"index.lifecycle.name": bootstrapCfg.PolicyName,
+			}
+		case "ism":
+			// the policy is attached to new indices by its ism_template, and
+			// no rollover_alias is set since the daily indices are not rolled over
+			if err := e.putISMPolicy(indexPattern); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported Elasticsearch lifecycle policy type: %s", bootstrapCfg.PolicyType)
+		}
+	}
+
+	if err := e.putIndexTemplate(indexPattern, templateSettings); err != nil {
+		return err
+	}
+	log.Infof("Installed Elasticsearch index template %s for %s", bootstrapCfg.TemplateName, indexPattern)
+	return nil
+}
+
+// putIndexTemplate creates or replaces the composable index template used
+// for the espy managed indices
+func (e ElasticWriter) putIndexTemplate(indexPattern string, settings map[string]interface{}) error {
+	if settings == nil {
+		settings = make(map[string]interface{})
+	}
+	// reject individual malformed fields (such as bad IPs) rather than whole documents
+	settings["index.mapping.ignore_malformed"] = true
+
+	body := map[string]interface{}{
+		"index_patterns": []string{indexPattern},
+		"priority":       200,
+		"template": map[string]interface{}{
+			"settings": settings,
+			"mappings": json.RawMessage(esMappings),
+		},
+		"_meta": map[string]interface{}{
+			"managed_by": "espy",
+		},
+	}
+
+	_, err := e.bootstrapRequest(
+		"PUT", "/_index_template/"+e.Bootstrap.TemplateName, body,
+		"install the index template", "manage_index_templates",
+	)
+	return err
+}
+
+// putILMPolicy creates or replaces the Elasticsearch ILM policy which
+// deletes espy managed indices after the configured retention period
+func (e ElasticWriter) putILMPolicy() error {
+	body := map[string]interface{}{
+		"policy": map[string]interface{}{
+			"phases": map[string]interface{}{
+				"hot": map[string]interface{}{
+					"min_age": "0ms",
+					"actions": map[string]interface{}{},
+				},
+				"delete": map[string]interface{}{
+					"min_age": fmt.Sprintf("%dd", e.Bootstrap.RetentionDays),
+					"actions": map[string]interface{}{
+						"delete": map[string]interface{}{},
+					},
+				},
+			},
+			"_meta": map[string]interface{}{
+				"managed_by": "espy",
+			},
+		},
+	}
+
+	_, err := e.bootstrapRequest(
+		"PUT", "/_ilm/policy/"+e.Bootstrap.PolicyName, body,
+		"install the ILM policy", "manage_ilm",
+	)
+	if err == nil {
+		log.Infof("Installed Elasticsearch ILM policy %s", e.Bootstrap.PolicyName)
+	}
+	return err
+}
+
+// putISMPolicy creates or updates the OpenSearch ISM policy which deletes
+// espy managed indices after the configured retention period. Unlike ILM,
+// ISM refuses to overwrite a policy unless the current revision is supplied.
+func (e ElasticWriter) putISMPolicy(indexPattern string) error {
+	policyPath := "/_plugins/_ism/policies/" + e.Bootstrap.PolicyName
+	action := "install the ISM policy"
+	privilege := "cluster:admin/opendistro/ism/policy/write"
+
+	// look up the current revision of the policy if it exists
+	existing, err := e.bootstrapRequest("GET", policyPath, nil, action, privilege)
+	if err != nil {
+		if respErr, ok := err.(esResponseError); !ok || respErr.status != http.StatusNotFound {
+			return err
+		}
+	}
+	if existing != nil {
+		var revision struct {
+			SeqNo       *int64 `json:"_seq_no"`
+			PrimaryTerm *int64 `json:"_primary_term"`
+		}
+		if err := json.Unmarshal(existing, &revision); err != nil {
+			return fmt.Errorf("could not parse existing ISM policy %s: %v", e.Bootstrap.PolicyName, err)
+		}
+		if revision.SeqNo != nil && revision.PrimaryTerm != nil {
+			policyPath = fmt.Sprintf("%s?if_seq_no=%d&if_primary_term=%d", policyPath, *revision.SeqNo, *revision.PrimaryTerm)
+		}
+	}
+
+	body := map[string]interface{}{
+		"policy": map[string]interface{}{
+			"description":   "Deletes espy managed indices after the retention period",
+			"default_state": "hot",
+			"states": []interface{}{
+				map[string]interface{}{
+					"name":    "hot",
+					"actions": []interface{}{},
+					"transitions": []interface{}{
+						map[string]interface{}{
+							"state_name": "delete",
+							"conditions": map[string]interface{}{
+								"min_index_age": fmt.Sprintf("%dd", e.Bootstrap.RetentionDays),
+							},
+						},
+					},
+				},
+				map[string]interface{}{
+					"name": "delete",
+					"actions": []interface{}{
+						map[string]interface{}{"delete": map[string]interface{}{}},
+					},
+					"transitions": []interface{}{},
+				},
+			},
+			"ism_template": []interface{}{
+				map[string]interface{}{
+					"index_patterns": []string{indexPattern},
+					"priority":       200,
+				},
+			},
+		},
+	}
+
+	_, err = e.bootstrapRequest("PUT", policyPath, body, action, privilege)
+	if err == nil {
+		log.Infof("Installed OpenSearch ISM policy %s", e.Bootstrap.PolicyName)
+	}
+	return err
+}
+
+// esResponseError is returned when Elasticsearch answers a bootstrap request
+// with an unexpected status code
+type esResponseError struct {
+	action string
+	status int
+	reason string
+}
+
+func (e esResponseError) Error() string {
+	return fmt.Sprintf("could not %s: elasticsearch HTTP Error: %d: %s", e.action, e.status, e.reason)
+}
+
+// bootstrapRequest sends a JSON encoded body to Elasticsearch and returns the
+// response body. Authentication and authorization failures are reported as
+// esPermissionErrors naming the privilege needed to perform the action.
+func (e ElasticWriter) bootstrapRequest(method, path string, body interface{}, action, privilege string) ([]byte, error) {
+	var reqBody bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&reqBody).Encode(body); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := e.do(context.Background(), method, path, reqBody.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("could not %s: %v", action, err)
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not %s: %v", action, err)
+	}
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return respBody, nil
+	}
+
+	reason := esErrorReason(respBody)
+	if resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden {
+		return nil, esPermissionError{
+			credentials: e.credentials(),
+			action:      action,
+			privilege:   privilege,
+			status:      resp.StatusCode,
+			reason:      reason,
+		}
+	}
+	return nil, esResponseError{action: action, status: resp.StatusCode, reason: reason}
+}
+
+// esErrorReason extracts the human readable reason from an Elasticsearch
+// error response, falling back to the raw response body
+func esErrorReason(respBody []byte) string {
+	var esErr struct {
+		Error struct {
+			Reason string `json:"reason"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(respBody, &esErr); err == nil && esErr.Error.Reason != "" {
+		return esErr.Error.Reason
+	}
+	return string(bytes.TrimSpace(respBody))
+}
@@ -0,0 +1,132 @@
+package output
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// esHost tracks the health of a single Elasticsearch node
+type esHost struct {
+	baseURL   string
+	failures  int
+	deadUntil time.Time
+}
+
+// esHostPool hands out Elasticsearch nodes in round-robin order, skipping
+// nodes which recently failed until their backoff period has passed
+type esHostPool struct {
+	mutex   sync.Mutex
+	hosts   []*esHost
+	next    int
+	backoff time.Duration
+}
+
+// maxBackoffFactor caps the exponential backoff applied to a node which
+// keeps failing
+const maxBackoffFactor = 32
+
+// newESHostPool creates a pool of Elasticsearch nodes from a list of host
+// addresses. Addresses without an explicit http:// or https:// prefix use
+// the given default scheme.
+func newESHostPool(hosts []string, scheme string, backoff time.Duration) (*esHostPool, error) {
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("no Elasticsearch hosts configured")
+	}
+
+	pool := &esHostPool{backoff: backoff}
+	for _, host := range hosts {
+		baseURL := host
+		if !strings.Contains(host, "://") {
+			baseURL = scheme + "://" + host
+		}
+		parsed, err := url.Parse(baseURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Elasticsearch host %q: %v", host, err)
+		}
+		if parsed.Scheme != "http" && parsed.Scheme != "https" {
+			return nil, fmt.Errorf("invalid scheme for Elasticsearch host %q: must be http or https", host)
+		}
+		pool.hosts = append(pool.hosts, &esHost{baseURL: strings.TrimSuffix(baseURL, "/")})
+	}
+	return pool, nil
+}
+
+// candidates returns every node in the order they should be tried for the
+// next request. Healthy nodes are returned in round-robin order, followed by
+// the failed nodes as a last resort.
+func (p *esHostPool) candidates(now time.Time) []*esHost {
+	healthy, dead := p.split(now)
+	return append(healthy, dead...)
+}
+
+// available returns the nodes which are not backing off after a failure
+// in round-robin order
+func (p *esHostPool) available(now time.Time) []*esHost {
+	healthy, _ := p.split(now)
+	return healthy
+}
+
+// split divides the nodes into those which are healthy and those which
+// are backing off after a failure, starting from the next node in turn
+func (p *esHostPool) split(now time.Time) (healthy, dead []*esHost) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	healthy = make([]*esHost, 0, len(p.hosts))
+	for i := range p.hosts {
+		host := p.hosts[(p.next+i)%len(p.hosts)]
+		if now.Before(host.deadUntil) {
+			dead = append(dead, host)
+		} else {
+			healthy = append(healthy, host)
+		}
+	}
+	p.next = (p.next + 1) % len(p.hosts)
+	return healthy, dead
+}
+
+// untilAvailable returns how long until the first node which is backing
+// off may be tried again, or zero if a node is available now
+func (p *esHostPool) untilAvailable(now time.Time) time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var wait time.Duration
+	for i, host := range p.hosts {
+		remaining := host.deadUntil.Sub(now)
+		if remaining <= 0 {
+			return 0
+		}
+		if i == 0 || remaining < wait {
+			wait = remaining
+		}
+	}
+	return wait
+}
+
+// markFailed takes a node out of rotation for an exponentially growing
+// backoff period
+func (p *esHostPool) markFailed(host *esHost, now time.Time) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	factor := 1 << uint(host.failures)
+	if factor > maxBackoffFactor {
+		factor = maxBackoffFactor
+	} else {
+		host.failures++
+	}
+	host.deadUntil = now.Add(p.backoff * time.Duration(factor))
+}
+
+// markHealthy returns a node to the rotation
+func (p *esHostPool) markHealthy(host *esHost) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	host.failures = 0
+	host.deadUntil = time.Time{}
+}
@@ -0,0 +1,361 @@
+package output
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/creasty/defaults"
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+)
+
+// newTestESConfig returns the default Elasticsearch configuration pointed
+// at the given test server
+func newTestESConfig(t *testing.T, server *httptest.Server) (config.ESStaticCfg, config.ESRunningCfg) {
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{server.URL}
+	static.User = "sysmon-ingest"
+	static.Bootstrap.Enable = true
+	running := config.ESRunningCfg{
+		TLSConfig: &tls.Config{InsecureSkipVerify: true},
+	}
+	return static, running
+}
+
+func TestElasticBootstrap(t *testing.T) {
+	var mu sync.Mutex
+	requests := make(map[string]map[string]interface{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path] = body
+		mu.Unlock()
+		w.Write([]byte(`{"acknowledged": true}`))
+	}))
+	defer server.Close()
+
+	static, running := newTestESConfig(t, server)
+	_, err := NewElasticWriter(static, running)
+	require.Nil(t, err, "Bootstrap should succeed")
+
+	policy, ok := requests["PUT /_ilm/policy/espy-sysmon"]
+	require.True(t, ok, "ILM policy should be installed")
+	require.Contains(t, policy, "policy")
+
+	template, ok := requests["PUT /_index_template/espy-sysmon"]
+	require.True(t, ok, "Index template should be installed")
+	require.Equal(t, []interface{}{"sysmon-*"}, template["index_patterns"])
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	require.Equal(t, "espy-sysmon", settings["index.lifecycle.name"])
+}
+
+func TestElasticBootstrapISM(t *testing.T) {
+	var mu sync.Mutex
+	var seqNo int
+	requests := make(map[string]map[string]interface{})
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == "GET" {
+			// answer like OpenSearch, which reports the revision of a stored policy
+			if seqNo == 0 {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(`{"error": {"type": "status_exception", "reason": "Policy not found"}, "status": 404}`))
+				return
+			}
+			fmt.Fprintf(w, `{"_id": "espy-sysmon", "_version": %d, "_seq_no": %d, "_primary_term": 1, "policy": {}}`, seqNo, seqNo)
+			return
+		}
+		body := make(map[string]interface{})
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		requests[r.Method+" "+r.URL.RequestURI()] = body
+		if strings.HasPrefix(r.URL.Path, "/_plugins/_ism/policies/") {
+			seqNo++
+			w.WriteHeader(http.StatusCreated)
+			fmt.Fprintf(w, `{"_id": "espy-sysmon", "_version": %d, "_seq_no": %d, "_primary_term": 1}`, seqNo, seqNo)
+			return
+		}
+		w.Write([]byte(`{"acknowledged": true}`))
+	}))
+	defer server.Close()
+
+	static, running := newTestESConfig(t, server)
+	static.Bootstrap.PolicyType = "ism"
+	static.Bootstrap.RetentionDays = 30
+	_, err := NewElasticWriter(static, running)
+	require.Nil(t, err, "Bootstrap should succeed")
+
+	body, ok := requests["PUT /_plugins/_ism/policies/espy-sysmon"]
+	require.True(t, ok, "ISM policy should be created without a revision")
+	policy := body["policy"].(map[string]interface{})
+	require.Equal(t, "hot", policy["default_state"])
+	states := policy["states"].([]interface{})
+	require.Len(t, states, 2)
+	transition := states[0].(map[string]interface{})["transitions"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, "delete", transition["state_name"])
+	require.Equal(t, map[string]interface{}{"min_index_age": "30d"}, transition["conditions"])
+	deleteState := states[1].(map[string]interface{})
+	require.Equal(t, []interface{}{map[string]interface{}{"delete": map[string]interface{}{}}}, deleteState["actions"])
+	ismTemplate := policy["ism_template"].([]interface{})[0].(map[string]interface{})
+	require.Equal(t, []interface{}{"sysmon-*"}, ismTemplate["index_patterns"])
+
+	template, ok := requests["PUT /_index_template/espy-sysmon"]
+	require.True(t, ok, "Index template should be installed")
+	settings := template["template"].(map[string]interface{})["settings"].(map[string]interface{})
+	require.NotContains(t, settings, "index.lifecycle.name", "ILM settings should not be sent to OpenSearch")
+	require.NotContains(t, settings, "plugins.index_state_management.rollover_alias", "The daily indices should not be rolled over")
+	require.NotContains(t, settings, "plugins.index_state_management.policy_id", "The policy should be attached by its ism_template")
+
+	_, err = NewElasticWriter(static, running)
+	require.Nil(t, err, "Bootstrapping again should update the policy")
+	_, ok = requests["PUT /_plugins/_ism/policies/espy-sysmon?if_seq_no=1&if_primary_term=1"]
+	require.True(t, ok, "The existing policy should be updated at its current revision")
+}
+
+func TestElasticBootstrapForbidden(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(`{"error": {"reason": "action [cluster:admin/ilm/put] is unauthorized"}}`))
+	}))
+	defer server.Close()
+
+	static, running := newTestESConfig(t, server)
+	_, err := NewElasticWriter(static, running)
+	require.NotNil(t, err, "Bootstrap should fail without permissions")
+	require.Contains(t, err.Error(), `user "sysmon-ingest" lacks permission`)
+	require.Contains(t, err.Error(), "manage_ilm")
+}
+
+func TestElasticFailover(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer down.Close()
+
+	var received int
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received++
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer up.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{down.URL, strings.TrimPrefix(up.URL, "http://")}
+	static.Scheme = "http"
+
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	for i := 0; i < 3; i++ {
+		err = writer.WriteECSEvents(context.Background(), []input.ECSEvent{{Raw: `{}`, Version: "7.10.0"}})
+		require.Nil(t, err, "Requests should fail over to the healthy node")
+	}
+	require.Equal(t, 3, received, "Every document should reach the healthy node")
+
+	hosts := writer.(ElasticWriter).hosts.candidates(time.Now())
+	require.Equal(t, up.URL, hosts[0].baseURL, "The failed node should be tried last")
+}
+
+func TestElasticHostScheme(t *testing.T) {
+	_, err := newESHostPool([]string{"ftp://127.0.0.1:9200"}, "https", time.Second)
+	require.NotNil(t, err, "Only http and https should be accepted")
+
+	pool, err := newESHostPool([]string{"127.0.0.1:9200", "http://127.0.0.2:9200/"}, "https", time.Second)
+	require.Nil(t, err)
+	require.Equal(t, "https://127.0.0.1:9200", pool.hosts[0].baseURL)
+	require.Equal(t, "http://127.0.0.2:9200", pool.hosts[1].baseURL)
+}
+
+func TestElasticAuthentication(t *testing.T) {
+	var authHeader string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authHeader = r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer server.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{server.URL}
+
+	static.APIKey = "VuaCfGcBCdbkQm-e5aOx:ui2lp2axTNmsyakw9tvNnw"
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+	require.Nil(t, writer.WriteECSEvents(context.Background(), []input.ECSEvent{{Raw: `{}`, Version: "7.10.0"}}))
+	require.Equal(t, "ApiKey VnVhQ2ZHY0JDZGJrUW0tZTVhT3g6dWkybHAyYXhUTm1zeWFrdzl0dk5udw==", authHeader)
+
+	static.APIKey = ""
+	static.BearerToken = "token"
+	writer, err = NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+	require.Nil(t, writer.WriteECSEvents(context.Background(), []input.ECSEvent{{Raw: `{}`, Version: "7.10.0"}}))
+	require.Equal(t, "Bearer token", authHeader)
+}
+
+func TestElasticBatchFailures(t *testing.T) {
+	var mu sync.Mutex
+	var received []string
+	throttled := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{})
+		require.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case body["id"] == "bad":
+			w.WriteHeader(http.StatusBadRequest)
+		case body["id"] == "busy" && throttled < 2:
+			throttled++
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			received = append(received, body["id"].(string))
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{server.URL}
+	static.RetryBackoff = time.Millisecond
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	err = writer.WriteECSEvents(context.Background(), []input.ECSEvent{
+		{Raw: `{"id": "first"}`, Version: "7.10.0"},
+		{Raw: `{"id": "bad"}`, Version: "7.10.0"},
+		{Raw: `{"id": "busy"}`, Version: "7.10.0"},
+		{Raw: `{"id": "last"}`, Version: "7.10.0"},
+	})
+	require.NotNil(t, err, "The rejected document should be reported")
+	require.Contains(t, err.Error(), "1 of 4 documents")
+	require.Equal(t, []string{"first", "busy", "last"}, received, "A failed document should not stop the rest of the batch and throttled documents should be retried")
+}
+
+func TestElasticReadyContext(t *testing.T) {
+	release := make(chan struct{})
+	hung := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer hung.Close()
+	defer close(release)
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{hung.URL}
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	require.NotNil(t, writer.(HealthChecker).Ready(ctx))
+	require.Less(t, int64(time.Since(start)), int64(time.Second), "The health check should give up when its context is done")
+
+	host := writer.(ElasticWriter).hosts.hosts[0]
+	require.True(t, host.deadUntil.IsZero(), "Health checks should not take nodes out of rotation")
+}
+
+func TestElasticWriteCancelled(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{server.URL}
+	static.RetryBackoff = time.Hour
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = writer.WriteECSEvents(ctx, []input.ECSEvent{
+		{Raw: `{}`, Version: "7.10.0"},
+		{Raw: `{}`, Version: "7.10.0"},
+	})
+	require.NotNil(t, err)
+	require.Contains(t, err.Error(), "2 of 2 documents")
+	require.Less(t, int64(time.Since(start)), int64(time.Second), "Waiting to retry should stop when the context is cancelled")
+}
+
+func TestElasticWaitsForFailedNodes(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	flaky := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests++
+		if requests <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer flaky.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{flaky.URL}
+	static.DeadHostBackoff = 10 * time.Millisecond
+	static.RetryBackoff = time.Millisecond
+	static.Retries = 0
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	err = writer.WriteECSEvents(context.Background(), []input.ECSEvent{{Raw: `{}`, Version: "7.10.0"}})
+	require.Nil(t, err, "The document should be written once the node recovers, regardless of Retries")
+	require.Equal(t, 4, requests)
+}
+
+func TestElasticSkipsFailedNodes(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	})
+	first := httptest.NewServer(handler)
+	defer first.Close()
+	second := httptest.NewServer(handler)
+	defer second.Close()
+
+	static := config.ESStaticCfg{}
+	require.Nil(t, defaults.Set(&static))
+	static.Hosts = []string{first.URL, second.URL}
+	static.DeadHostBackoff = time.Hour
+	writer, err := NewElasticWriter(static, config.ESRunningCfg{})
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err = writer.WriteECSEvents(ctx, []input.ECSEvent{
+		{Raw: `{}`, Version: "7.10.0"},
+		{Raw: `{}`, Version: "7.10.0"},
+		{Raw: `{}`, Version: "7.10.0"},
+	})
+	require.NotNil(t, err)
+	mu.Lock()
+	defer mu.Unlock()
+	require.Equal(t, 2, requests, "Nodes which are backing off should not be tried for every document")
+}
@@ -0,0 +1,54 @@
+package output
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/input"
+)
+
+// NamedOutput pairs an Output with the name it was configured with
+type NamedOutput struct {
+	Name string
+	Output
+}
+
+// MultiOutput sends every event to each of its outputs in order.
+// An output which fails to write the events is logged and skipped
+// so that it does not prevent the other outputs from receiving them.
+type MultiOutput []NamedOutput
+
+// WriteECSEvents writes the events to every output. Errors are logged
+// rather than returned since they only affect the output which failed.
+func (m MultiOutput) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	for i := range m {
+		m[i].WriteOrLog(ctx, events)
+	}
+	return nil
+}
+
+// WriteOrLog writes the events to the output and logs any failure
+func (n NamedOutput) WriteOrLog(ctx context.Context, events []input.ECSEvent) {
+	if err := n.WriteECSEvents(ctx, events); err != nil {
+		entry := log.WithError(err).WithField("output", n.Name)
+		if len(events) == 1 {
+			entry = entry.WithField("input", events[0].Raw)
+		}
+		entry.Error("Could not write events to output.")
+	}
+}
+
+// Close closes every output, returning the first error encountered
+func (m MultiOutput) Close() error {
+	var firstErr error
+	for i := range m {
+		if err := m[i].Close(); err != nil {
+			log.WithError(err).WithField("output", m[i].Name).Error("Error encountered while closing output.")
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,51 @@
+package output
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/input"
+)
+
+// recordingOutput remembers the events written to it and
+// optionally fails every write
+type recordingOutput struct {
+	events []input.ECSEvent
+	fail   bool
+	closed bool
+}
+
+func (r *recordingOutput) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	if r.fail {
+		return errors.New("output unavailable")
+	}
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func (r *recordingOutput) Close() error {
+	r.closed = true
+	if r.fail {
+		return errors.New("output unavailable")
+	}
+	return nil
+}
+
+func TestMultiOutputIsolatesFailures(t *testing.T) {
+	failing := &recordingOutput{fail: true}
+	healthy := &recordingOutput{}
+	outputs := MultiOutput{
+		{Name: "failing", Output: failing},
+		{Name: "healthy", Output: healthy},
+	}
+
+	require.Nil(t, outputs.WriteECSEvents(context.Background(), []input.ECSEvent{{Raw: `{}`}}))
+	require.Len(t, healthy.events, 1, "A failing output should not block the others")
+
+	require.NotNil(t, outputs.Close(), "Close errors should be reported")
+	require.True(t, failing.closed)
+	require.True(t, healthy.closed, "Every output should be closed")
+}
@@ -0,0 +1,25 @@
+package output
+
+import (
+	"context"
+
+	"github.com/activecm/espy/espy/input"
+)
+
+// Output is implemented by every espy output plugin
+type Output interface {
+	//WriteECSEvents writes out events received from Redis, giving up
+	//on any events not yet written once the context is cancelled
+	WriteECSEvents(ctx context.Context, events []input.ECSEvent) error
+	//Close frees any resources held by this output
+	Close() error
+}
+
+// HealthChecker is implemented by outputs which can report their
+// health to the monitoring endpoints
+type HealthChecker interface {
+	//Alive returns an error if the output has failed in a way it cannot recover from
+	Alive(ctx context.Context) error
+	//Ready returns an error if the output cannot currently write events
+	Ready(ctx context.Context) error
+}
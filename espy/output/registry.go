@@ -0,0 +1,72 @@
+package output
+
+import (
+	"fmt"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// Environment holds the process wide resources outputs are created with
+type Environment struct {
+	Fs    afero.Fs
+	Clock clock.Clock
+	// CrashFunc is called when an output hits an unrecoverable
+	// error outside of WriteECSEvents, such as in a background goroutine
+	CrashFunc func()
+}
+
+// Factory creates an Output from its static and running configuration
+type Factory func(static config.OutputCfg, running config.OutputRunningCfg, env Environment) (Output, error)
+
+// Checker tests whether an output could be created from its configuration,
+// such as by connecting to a remote service, without creating it
+type Checker func(static config.OutputCfg, running config.OutputRunningCfg, env Environment) error
+
+// registeredOutputs maps the output types which may be used in the
+// Outputs config section to their factories. Output plugins add
+// themselves to the registry with Register when their package is imported.
+var registeredOutputs = make(map[string]Factory)
+
+// registeredCheckers maps output types to their optional Checkers
+var registeredCheckers = make(map[string]Checker)
+
+// Register makes an output type available for use in the Outputs config section
+func Register(outputType string, factory Factory) {
+	if _, exists := registeredOutputs[outputType]; exists {
+		panic(fmt.Sprintf("output type %q registered twice", outputType))
+	}
+	registeredOutputs[outputType] = factory
+}
+
+// New creates the output described by the given configuration
+func New(static config.OutputCfg, running config.OutputRunningCfg, env Environment) (Output, error) {
+	factory, ok := registeredOutputs[static.Type]
+	if !ok {
+		return nil, fmt.Errorf("output %q has unknown type %q", static.Name, static.Type)
+	}
+	return factory(static, running, env)
+}
+
+// RegisterChecker adds a Checker for an output type which has been registered
+func RegisterChecker(outputType string, checker Checker) {
+	if _, exists := registeredCheckers[outputType]; exists {
+		panic(fmt.Sprintf("output type %q checker registered twice", outputType))
+	}
+	registeredCheckers[outputType] = checker
+}
+
+// Check tests the output described by the given configuration without
+// creating it. Outputs of types which have no Checker only have their
+// type checked.
+func Check(static config.OutputCfg, running config.OutputRunningCfg, env Environment) error {
+	if _, ok := registeredOutputs[static.Type]; !ok {
+		return fmt.Errorf("output %q has unknown type %q", static.Name, static.Type)
+	}
+	if checker, ok := registeredCheckers[static.Type]; ok {
+		return checker(static, running, env)
+	}
+	return nil
+}
@@ -0,0 +1,255 @@
+package output
+
+import (
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// Matcher checks events against the criteria in a config.MatchCfg
+type Matcher struct {
+	providers      []string
+	eventCodes     []string
+	agentHostnames []string
+	agentIDs       []string
+	keys           []string
+	ipRanges       []*net.IPNet
+	tags           []string
+	// hostIPsOnly limits the IP ranges to the host IPs of the record
+	hostIPsOnly bool
+}
+
+// NewMatcher compiles the criteria in a config.MatchCfg
+func NewMatcher(cfg config.MatchCfg) (*Matcher, error) {
+	m := &Matcher{
+		providers:      cfg.Providers,
+		eventCodes:     cfg.EventCodes,
+		agentHostnames: cfg.AgentHostnames,
+		agentIDs:       cfg.AgentIDs,
+		keys:           cfg.Keys,
+		tags:           cfg.Tags,
+	}
+
+	for _, patterns := range [][]string{m.agentHostnames, m.agentIDs, m.keys} {
+		for _, pattern := range patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+			}
+		}
+	}
+
+	for _, ipRange := range cfg.IPRanges {
+		_, ipNet, err := net.ParseCIDR(ipRange)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IP range %q: %v", ipRange, err)
+		}
+		m.ipRanges = append(m.ipRanges, ipNet)
+	}
+	return m, nil
+}
+
+// NewHostMatcher compiles the criteria in a config.MatchCfg like NewMatcher,
+// except that the IP ranges are only checked against the host IPs of the
+// record, so the events of an agent are not matched by the IPs it talks to
+func NewHostMatcher(cfg config.MatchCfg) (*Matcher, error) {
+	m, err := NewMatcher(cfg)
+	if err != nil {
+		return nil, err
+	}
+	m.hostIPsOnly = true
+	return m, nil
+}
+
+// Matches returns true if the event meets every criteria set in the Matcher
+func (m *Matcher) Matches(event *input.ECSEvent) bool {
+	record := &event.Record
+	if len(m.providers) != 0 && !containsFold(m.providers, record.Event.Provider) {
+		return false
+	}
+	if len(m.eventCodes) != 0 && !containsFold(m.eventCodes, record.Event.Code.String()) {
+		return false
+	}
+	// Windows hostnames are case insensitive
+	if len(m.agentHostnames) != 0 && !matchesAnyPattern(m.agentHostnames, strings.ToLower(record.Agent.Hostname), true) {
+		return false
+	}
+	if len(m.agentIDs) != 0 && !matchesAnyPattern(m.agentIDs, record.Agent.ID, false) {
+		return false
+	}
+	if len(m.keys) != 0 && !matchesAnyPattern(m.keys, event.Key, false) {
+		return false
+	}
+	if len(m.ipRanges) != 0 && !m.matchesIPRange(record) {
+		return false
+	}
+	if len(m.tags) != 0 && !containsAny(m.tags, record.Tags) {
+		return false
+	}
+	return true
+}
+
+// matchesIPRange returns true if the source, destination, or any of the
+// host IPs of the record fall in one of the Matcher's IP ranges. Only the
+// host IPs are checked if the Matcher was created by NewHostMatcher.
+func (m *Matcher) matchesIPRange(record *input.ECSRecord) bool {
+	ips := make([]string, 0, len(record.Host.IP)+2)
+	if !m.hostIPsOnly {
+		ips = append(ips, record.Source.IP, record.Destination.IP)
+	}
+	ips = append(ips, record.Host.IP...)
+	for _, ipStr := range ips {
+		ip := net.ParseIP(ipStr)
+		if ip == nil {
+			continue
+		}
+		for _, ipNet := range m.ipRanges {
+			if ipNet.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// containsFold returns true if value case insensitively equals one of the values
+func containsFold(values []string, value string) bool {
+	for i := range values {
+		if strings.EqualFold(values[i], value) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsAny returns true if any of the wanted values is in the given values
+func containsAny(wanted []string, values []string) bool {
+	for i := range values {
+		for j := range wanted {
+			if values[i] == wanted[j] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchesAnyPattern returns true if value matches one of the shell style patterns
+func matchesAnyPattern(patterns []string, value string, lower bool) bool {
+	for _, pattern := range patterns {
+		if lower {
+			pattern = strings.ToLower(pattern)
+		}
+		// patterns are checked when the Matcher is created
+		if matched, _ := path.Match(pattern, value); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// route is a compiled routing rule
+type route struct {
+	matcher *Matcher
+	outputs []int
+	final   bool
+}
+
+// Router selects the outputs each event should be sent to
+type Router struct {
+	routes   []route
+	defaults []int
+	all      []int
+	// warnDropped warns the first time an event matches no rules
+	// and is dropped for lack of a default route
+	warnDropped sync.Once
+}
+
+// NewRouter compiles the routing rules for the given list of output names.
+// The outputs chosen by the Router are returned as indexes into this list.
+func NewRouter(cfg config.RoutingCfg, outputNames []string) (*Router, error) {
+	outputIndexes := make(map[string]int, len(outputNames))
+	r := &Router{}
+	for i, name := range outputNames {
+		outputIndexes[name] = i
+		r.all = append(r.all, i)
+	}
+
+	lookup := func(names []string) ([]int, error) {
+		indexes := make([]int, 0, len(names))
+		for _, name := range names {
+			idx, ok := outputIndexes[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown output %q", name)
+			}
+			indexes = append(indexes, idx)
+		}
+		return indexes, nil
+	}
+
+	var err error
+	if r.defaults, err = lookup(cfg.Default); err != nil {
+		return nil, fmt.Errorf("default route: %v", err)
+	}
+
+	for i, rule := range cfg.Rules {
+		compiled := route{final: rule.Final}
+		if compiled.matcher, err = NewMatcher(rule.MatchCfg); err != nil {
+			return nil, fmt.Errorf("routing rule %d: %v", i+1, err)
+		}
+		if compiled.outputs, err = lookup(rule.Outputs); err != nil {
+			return nil, fmt.Errorf("routing rule %d: %v", i+1, err)
+		}
+		r.routes = append(r.routes, compiled)
+	}
+	return r, nil
+}
+
+// Route returns the indexes of the outputs the event should be sent to
+// in ascending order. Without any routing rules, every output is returned.
+func (r *Router) Route(event *input.ECSEvent) []int {
+	if len(r.routes) == 0 {
+		return r.all
+	}
+
+	selected := make([]bool, len(r.all))
+	matched := false
+	for i := range r.routes {
+		if !r.routes[i].matcher.Matches(event) {
+			continue
+		}
+		matched = true
+		for _, idx := range r.routes[i].outputs {
+			selected[idx] = true
+		}
+		if r.routes[i].final {
+			break
+		}
+	}
+
+	if !matched {
+		if len(r.defaults) == 0 {
+			metrics.EventsUnrouted.Inc()
+			r.warnDropped.Do(func() {
+				log.WithField("provider", event.Record.Event.Provider).
+					WithField("code", event.Record.Event.Code.String()).
+					Warn("Dropping events which match no routing rules since there is no default route.")
+			})
+		}
+		return r.defaults
+	}
+
+	outputs := make([]int, 0, len(selected))
+	for idx := range selected {
+		if selected[idx] {
+			outputs = append(outputs, idx)
+		}
+	}
+	return outputs
+}
@@ -0,0 +1,103 @@
+package output
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
+)
+
+func newTestEvent(code string, hostname string, sourceIP string) input.ECSEvent {
+	event := input.ECSEvent{Key: "net-data:sysmon"}
+	event.Record.Event.Provider = "Microsoft-Windows-Sysmon"
+	event.Record.Event.Code = json.Number(code)
+	event.Record.Agent.Hostname = hostname
+	event.Record.Source.IP = sourceIP
+	return event
+}
+
+func TestRouter(t *testing.T) {
+	outputNames := []string{"elasticsearch", "zeek-main", "zeek-dmz", "archive"}
+	routing := config.RoutingCfg{
+		Rules: []config.RouteCfg{
+			{
+				// send everything to the archive
+				Outputs: []string{"archive"},
+			},
+			{
+				MatchCfg: config.MatchCfg{EventCodes: []string{"22"}},
+				Outputs:  []string{"elasticsearch"},
+				Final:    true,
+			},
+			{
+				MatchCfg: config.MatchCfg{
+					EventCodes:     []string{"3"},
+					AgentHostnames: []string{"DMZ-*"},
+				},
+				Outputs: []string{"zeek-dmz"},
+				Final:   true,
+			},
+			{
+				MatchCfg: config.MatchCfg{EventCodes: []string{"3"}},
+				Outputs:  []string{"zeek-main"},
+			},
+		},
+	}
+
+	router, err := NewRouter(routing, outputNames)
+	require.Nil(t, err)
+
+	dnsEvent := newTestEvent("22", "dmz-web01", "10.0.0.1")
+	require.Equal(t, []int{0, 3}, router.Route(&dnsEvent), "DNS events should only go to Elasticsearch and the archive")
+
+	dmzEvent := newTestEvent("3", "dmz-web01", "10.0.0.1")
+	require.Equal(t, []int{2, 3}, router.Route(&dmzEvent), "DMZ conn events should go to the DMZ Zeek directory")
+
+	connEvent := newTestEvent("3", "workstation", "10.0.0.1")
+	require.Equal(t, []int{1, 3}, router.Route(&connEvent), "Other conn events should go to the main Zeek directory")
+}
+
+func TestRouterDefaults(t *testing.T) {
+	outputNames := []string{"zeek-main", "zeek-lab"}
+	router, err := NewRouter(config.RoutingCfg{}, outputNames)
+	require.Nil(t, err)
+	event := newTestEvent("3", "workstation", "10.0.0.1")
+	require.Equal(t, []int{0, 1}, router.Route(&event), "Events should go everywhere without routing rules")
+
+	router, err = NewRouter(config.RoutingCfg{
+		Rules: []config.RouteCfg{{
+			MatchCfg: config.MatchCfg{IPRanges: []string{"192.168.0.0/16"}},
+			Outputs:  []string{"zeek-lab"},
+		}},
+		Default: []string{"zeek-main"},
+	}, outputNames)
+	require.Nil(t, err)
+	require.Equal(t, []int{0}, router.Route(&event), "Unmatched events should use the default route")
+
+	labEvent := newTestEvent("3", "workstation", "192.168.1.5")
+	require.Equal(t, []int{1}, router.Route(&labEvent), "Events should be matched by IP range")
+
+	_, err = NewRouter(config.RoutingCfg{
+		Rules: []config.RouteCfg{{
+			MatchCfg: config.MatchCfg{IPRanges: []string{"192.168.0.0"}},
+		}},
+	}, outputNames)
+	require.NotNil(t, err, "Invalid IP ranges should be rejected")
+
+	router, err = NewRouter(config.RoutingCfg{
+		Rules: []config.RouteCfg{{
+			MatchCfg: config.MatchCfg{IPRanges: []string{"192.168.0.0/16"}},
+			Outputs:  []string{"zeek-lab"},
+		}},
+		DropUnmatched: true,
+	}, outputNames)
+	require.Nil(t, err)
+	dropped := testutil.ToFloat64(metrics.EventsUnrouted)
+	require.Empty(t, router.Route(&event), "Unmatched events should be dropped without a default route")
+	require.Equal(t, dropped+1, testutil.ToFloat64(metrics.EventsUnrouted), "Dropped events should be counted")
+}
@@ -0,0 +1,163 @@
+package zeek
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// archiveFile compresses the file at srcPath into an archive at
+// archivePath and removes the source file. The archive is written to a
+// temporary file which is synced to disk and then renamed into place, so
+// an archive is either complete or missing if espy stops partway through.
+// If an archive already exists at archivePath, the new archive is marked
+// as a duplicate rather than replacing it. It returns the path the archive was written to
+// and the size of the uncompressed file.
+func (c compressor) archiveFile(fs afero.Fs, srcPath, archivePath string) (string, int64, error) {
+	dir := path.Dir(archivePath)
+	tmpPath := tempArchivePath(archivePath)
+
+	var size int64
+	var err error
+	if c.newWriter == nil {
+		// the spool file is moved into place as is
+		size, err = syncFile(fs, srcPath)
+		tmpPath = srcPath
+	} else {
+		size, err = c.compressFile(fs, srcPath, tmpPath)
+	}
+	if err != nil {
+		if tmpPath != srcPath {
+			fs.Remove(tmpPath)
+		}
+		return "", 0, err
+	}
+
+	archivePath = c.uniquePath(fs, archivePath)
+	if err := fs.Rename(tmpPath, archivePath); err != nil {
+		if tmpPath != srcPath {
+			fs.Remove(tmpPath)
+		}
+		return "", 0, err
+	}
+	if err := syncDir(fs, dir); err != nil {
+		log.WithError(err).WithField("dir", dir).Debug("Could not sync the archive directory")
+	}
+
+	// only remove the spool once its archive is in place
+	if tmpPath != srcPath {
+		if err := fs.Remove(srcPath); err != nil {
+			return archivePath, size, err
+		}
+	}
+	return archivePath, size, nil
+}
+
+// compressFile compresses the file at srcPath into a new file at dstPath
+// and syncs it to disk, returning the size of the uncompressed file
+func (c compressor) compressFile(fs afero.Fs, srcPath, dstPath string) (int64, error) {
+	srcFile, err := fs.Open(srcPath)
+	if err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := fs.OpenFile(dstPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer dstFile.Close()
+
+	out, err := c.newWriter(dstFile)
+	if err != nil {
+		return 0, err
+	}
+
+	// copy contents from source file to the compressed file
+	size, err := io.Copy(out, srcFile)
+	if err != nil {
+		out.Close()
+		return 0, err
+	}
+	if err := out.Close(); err != nil {
+		return 0, err
+	}
+	if err := dstFile.Sync(); err != nil {
+		return 0, err
+	}
+	return size, dstFile.Close()
+}
+
+// tempArchivePrefix and tempArchiveSuffix mark the hidden files archives
+// are written to, so that only espy's own temporary files are cleaned up
+const (
+	tempArchivePrefix = ".espy-"
+	tempArchiveSuffix = ".tmp"
+)
+
+// tempArchivePath returns the hidden file an archive is written to
+// before it is renamed into place
+func tempArchivePath(archivePath string) string {
+	return path.Join(path.Dir(archivePath), tempArchivePrefix+path.Base(archivePath)+tempArchiveSuffix)
+}
+
+// isTempArchive returns true if the file name is that of an archive
+// which espy was still writing
+func isTempArchive(name string) bool {
+	return strings.HasPrefix(name, tempArchivePrefix) && strings.HasSuffix(name, tempArchiveSuffix)
+}
+
+// duplicateSuffix marks an archive written where one already existed.
+// It differs from the plain numbers of the parts of a period.
+const duplicateSuffix = ".dup"
+
+// uniquePath returns the given archive path, marking it as a
+// numbered duplicate if an archive has already been written there
+func (c compressor) uniquePath(fs afero.Fs, archivePath string) string {
+	base := strings.TrimSuffix(archivePath, c.extension)
+	unique := archivePath
+	for n := 1; ; n++ {
+		exists, err := afero.Exists(fs, unique)
+		if err != nil || !exists {
+			break
+		}
+		unique = fmt.Sprintf("%s%s%d%s", base, duplicateSuffix, n, c.extension)
+	}
+	if unique != archivePath {
+		log.WithField("file", archivePath).Warnf("Archive already exists, writing to %s instead", unique)
+	}
+	return unique
+}
+
+// syncFile flushes a closed file to disk, returning its size
+func syncFile(fs afero.Fs, filePath string) (int64, error) {
+	file, err := fs.OpenFile(filePath, os.O_RDWR, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if err := file.Sync(); err != nil {
+		return 0, err
+	}
+	return info.Size(), file.Close()
+}
+
+// syncDir flushes a directory to disk so that files renamed into it
+// are not lost if the machine goes down
+func syncDir(fs afero.Fs, dir string) error {
+	file, err := fs.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
@@ -0,0 +1,63 @@
+package zeek
+
+import (
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Close() error                { return nil }
+
+func TestArchiveCollision(t *testing.T) {
+	for _, method := range []string{CompressionGzip, CompressionNone} {
+		fs := afero.NewMemMapFs()
+		zeekCfg := newTestZeekCfg(t)
+		zeekCfg.Compression = method
+		compressor, err := newCompressor(zeekCfg)
+		require.Nil(t, err)
+
+		archivePath := "/logs/conn" + compressor.extension
+		require.Nil(t, afero.WriteFile(fs, archivePath, []byte("earlier"), 0644))
+		require.Nil(t, afero.WriteFile(fs, "/logs/conn.dup1"+compressor.extension, []byte("earlier"), 0644))
+		require.Nil(t, afero.WriteFile(fs, "/spool/conn.log", []byte("#separator \\x09\n"), 0644))
+
+		written, _, err := compressor.archiveFile(fs, "/spool/conn.log", archivePath)
+		require.Nil(t, err, method)
+		require.Equal(t, "/logs/conn.dup2"+compressor.extension, written, "An existing %s archive should not be replaced", method)
+
+		contents, err := afero.ReadFile(fs, archivePath)
+		require.Nil(t, err)
+		require.Equal(t, "earlier", string(contents))
+
+		exists, err := afero.Exists(fs, "/spool/conn.log")
+		require.Nil(t, err)
+		require.False(t, exists, "The spool should be removed once archived")
+	}
+}
+
+func TestArchiveFailure(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	require.Nil(t, afero.WriteFile(fs, "/spool/conn.log", []byte("#separator \\x09\n"), 0644))
+	require.Nil(t, fs.MkdirAll("/logs", 0755))
+	compressor := compressor{
+		extension: ".log.gz",
+		newWriter: func(io.Writer) (io.WriteCloser, error) { return failingWriter{}, nil },
+	}
+
+	_, _, err := compressor.archiveFile(fs, "/spool/conn.log", "/logs/conn.log.gz")
+	require.NotNil(t, err)
+
+	entries, err := afero.ReadDir(fs, "/logs")
+	require.Nil(t, err)
+	require.Empty(t, entries, "Neither the archive nor its temporary file should be left behind")
+
+	exists, err := afero.Exists(fs, "/spool/conn.log")
+	require.Nil(t, err)
+	require.True(t, exists, "The spool should be kept if it could not be archived")
+}
@@ -0,0 +1,350 @@
+package zeek
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/activecm/espy/espy/metrics"
+)
+
+// archiveQueueSize is the number of rotations which may wait to be
+// compressed before rotating blocks until the archiver catches up
+const archiveQueueSize = 64
+
+// archiveManifest lists the archives espy wrote to a dated directory,
+// one per line relative to the directory, so that the janitor only
+// deletes espy's own archives
+const archiveManifest = ".espy-archives"
+
+// pendingArchive is a closed spool file waiting to be compressed
+type pendingArchive struct {
+	// src is the closed spool file in the pending directory
+	src string
+	// dst is the path of the archive to write
+	dst string
+}
+
+// archiveJob is the set of closed spool files from a single rotation
+type archiveJob struct {
+	files []pendingArchive
+	// rotation is passed on to the hooks once the files are archived
+	rotation Rotation
+}
+
+// failedArchive is a pending file which could not be archived
+type failedArchive struct {
+	file     pendingArchive
+	rotation Rotation
+	err      error
+}
+
+// archiver compresses the spool files closed by a Zeek writer in the
+// background, so that writing new records does not wait on compression.
+// Rotations are archived one at a time in the order they happened.
+// A file which cannot be archived is left in the pending directory and
+// tried again before the next rotation is archived, or the next time
+// espy starts.
+type archiver struct {
+	fs         afero.Fs
+	dir        string
+	pendingDir string
+	compressor compressor
+	hooks      *hookRunner
+
+	jobs    chan archiveJob
+	done    chan struct{}
+	pending sync.WaitGroup
+	closing sync.Once
+
+	mutex sync.Mutex
+	// failed holds the files which could not be archived, in the order
+	// they failed. Every failure is counted in the ZeekArchiveFailures metric.
+	failed []failedArchive
+}
+
+// newArchiver starts an archiver writing archives to the given directory
+// from the files staged in pendingDir and running the hooks, if any,
+// for each rotation it archives
+func newArchiver(fs afero.Fs, dir string, pendingDir string, compressor compressor, hooks *hookRunner) *archiver {
+	a := &archiver{
+		fs:         fs,
+		dir:        dir,
+		pendingDir: pendingDir,
+		compressor: compressor,
+		hooks:      hooks,
+		jobs:       make(chan archiveJob, archiveQueueSize),
+		done:       make(chan struct{}),
+	}
+	go a.run()
+	return a
+}
+
+// queue hands the files of a rotation to the archiver. It only blocks
+// if archiveQueueSize rotations are already waiting to be archived.
+func (a *archiver) queue(job archiveJob) {
+	if len(job.files) == 0 {
+		return
+	}
+	a.pending.Add(1)
+	metrics.ZeekArchivesPending.WithLabelValues(a.dir).Add(float64(len(job.files)))
+	a.jobs <- job
+}
+
+// flush waits for the rotations queued so far to be archived
+func (a *archiver) flush() {
+	a.pending.Wait()
+}
+
+// close waits for the queued rotations to be archived and stops the archiver
+func (a *archiver) close() {
+	a.closing.Do(func() { close(a.jobs) })
+	<-a.done
+}
+
+// err returns an error while any files which could not be archived
+// are still waiting to be
+func (a *archiver) err() error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.failed) > 0 {
+		return fmt.Errorf("%d logs could not be archived: %v", len(a.failed), a.failed[len(a.failed)-1].err)
+	}
+	return nil
+}
+
+func (a *archiver) run() {
+	defer close(a.done)
+	for job := range a.jobs {
+		a.archive(job)
+		a.pending.Done()
+	}
+}
+
+// archive tries the files which failed to archive earlier again, then
+// compresses the files of a rotation
+func (a *archiver) archive(job archiveJob) {
+	a.mutex.Lock()
+	retries := a.failed
+	a.failed = nil
+	a.mutex.Unlock()
+	for _, failed := range retries {
+		if !fileExists(a.fs, failed.file.src) {
+			log.WithField("file", failed.file.src).Warn("A rotated log which could not be archived is gone, it will not be retried")
+			metrics.ZeekArchivesPending.WithLabelValues(a.dir).Dec()
+			continue
+		}
+		log.WithField("file", failed.file.src).Info("Retrying a rotated log which could not be archived")
+		a.archiveFiles([]pendingArchive{failed.file}, failed.rotation)
+	}
+
+	a.archiveFiles(job.files, job.rotation)
+}
+
+// archiveFiles compresses the files of a rotation and then runs the hooks
+// for the archives which were written. The files which fail are kept to
+// be tried again.
+func (a *archiver) archiveFiles(files []pendingArchive, rotation Rotation) {
+	rotation.Archives = nil
+	for _, file := range files {
+		start := time.Now()
+		archivePath, size, err := a.archiveFile(file)
+		if err != nil && archivePath == "" {
+			log.WithError(err).WithFields(log.Fields{
+				"file":    file.src,
+				"archive": file.dst,
+			}).Error("Could not archive the rotated log, it will be retried at the next rotation")
+			metrics.ZeekArchiveFailures.WithLabelValues(a.dir).Inc()
+			a.mutex.Lock()
+			a.failed = append(a.failed, failedArchive{file: file, rotation: rotation, err: err})
+			a.mutex.Unlock()
+			continue
+		}
+		metrics.ZeekArchivesPending.WithLabelValues(a.dir).Dec()
+		if err != nil {
+			// retrying would archive the log a second time
+			log.WithError(err).WithField("file", file.src).Error("Archived the rotated log but could not remove it")
+		}
+		metrics.ZeekArchiveDuration.WithLabelValues(a.dir).Observe(time.Since(start).Seconds())
+		if err := a.recordArchive(archivePath); err != nil {
+			log.WithError(err).WithField("file", archivePath).Warn("Could not record the archive, it will not be deleted by the retention policies")
+		}
+		log.Infof("Log written: %s    size: %d", archivePath, size)
+		rotation.Archives = append(rotation.Archives, archivePath)
+	}
+
+	if a.hooks != nil && len(rotation.Archives) > 0 {
+		sort.Strings(rotation.Archives)
+		a.hooks.notify(rotation)
+	}
+}
+
+// recordArchive adds an archive to the manifest of the dated directory
+// it was written to. Archives which are not in a directory below the
+// archive directory are not recorded.
+func (a *archiver) recordArchive(archivePath string) error {
+	parts := strings.SplitN(strings.TrimPrefix(archivePath, a.dir+"/"), "/", 2)
+	if len(parts) < 2 {
+		return nil
+	}
+	manifest, err := a.fs.OpenFile(path.Join(a.dir, parts[0], archiveManifest), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(manifest, parts[1])
+	if closeErr := manifest.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// archiveFile compresses a single pending file into its archive
+func (a *archiver) archiveFile(file pendingArchive) (string, int64, error) {
+	if err := a.fs.MkdirAll(path.Dir(file.dst), 0755); err != nil {
+		return "", 0, err
+	}
+	return a.compressor.archiveFile(a.fs, file.src, file.dst)
+}
+
+// pendingPath returns where a closed spool file waits to be compressed
+// into the given archive. The pending directory mirrors the layout of
+// the archive directory.
+func (a *archiver) pendingPath(archivePath string) string {
+	rel := strings.TrimPrefix(archivePath, a.dir+"/")
+	return path.Join(a.pendingDir, strings.TrimSuffix(rel, a.compressor.extension)+".log")
+}
+
+// archivePath returns the archive a pending file is compressed into
+func (a *archiver) archivePath(pendingPath string) string {
+	rel := strings.TrimPrefix(pendingPath, a.pendingDir+"/")
+	return path.Join(a.dir, strings.TrimSuffix(rel, ".log")+a.compressor.extension)
+}
+
+// exists returns true if the given archive has already been
+// written or is waiting to be written
+func (a *archiver) exists(archivePath string) bool {
+	return fileExists(a.fs, archivePath) || fileExists(a.fs, a.pendingPath(archivePath))
+}
+
+// stage moves a closed spool file into the pending directory so that a
+// new spool file can be opened in its place while it waits to be
+// compressed into the given archive
+func (a *archiver) stage(spoolPath, archivePath string) (pendingArchive, error) {
+	pendingPath := a.pendingPath(archivePath)
+	if err := a.fs.MkdirAll(path.Dir(pendingPath), 0755); err != nil {
+		return pendingArchive{}, err
+	}
+	// never replace a file which is still waiting to be archived
+	base := strings.TrimSuffix(pendingPath, ".log")
+	for n := 1; fileExists(a.fs, pendingPath); n++ {
+		pendingPath = fmt.Sprintf("%s%s%d.log", base, duplicateSuffix, n)
+	}
+	if err := a.fs.Rename(spoolPath, pendingPath); err != nil {
+		return pendingArchive{}, err
+	}
+	return pendingArchive{src: pendingPath, dst: a.archivePath(pendingPath)}, nil
+}
+
+// recoverPending queues the files left in the pending directory by a
+// previous run which stopped before it could archive them, and removes
+// the directories which have been emptied along with any archives left
+// half written. The times of the files are read in the given location.
+func (a *archiver) recoverPending(location *time.Location) error {
+	exists, err := afero.DirExists(a.fs, a.pendingDir)
+	if err != nil || !exists {
+		return err
+	}
+
+	var files, dirs []string
+	err = afero.Walk(a.fs, a.pendingDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, filePath)
+		} else if strings.HasSuffix(filePath, ".log") {
+			files = append(files, filePath)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// remove the directories which have been emptied, deepest first
+	for i := len(dirs) - 1; i > 0; i-- {
+		if empty, err := afero.IsEmpty(a.fs, dirs[i]); err == nil && empty {
+			a.fs.Remove(dirs[i])
+		}
+	}
+
+	// a pending file is only removed once its archive is in place, so any
+	// archive left half written is next to the archive of a pending file
+	archiveDirs := make(map[string]bool)
+	for _, filePath := range files {
+		archiveDir := path.Dir(a.archivePath(filePath))
+		if archiveDirs[archiveDir] {
+			continue
+		}
+		archiveDirs[archiveDir] = true
+		if err := a.removeTempFiles(archiveDir); err != nil {
+			return err
+		}
+	}
+
+	for _, filePath := range files {
+		info, err := a.fs.Stat(filePath)
+		if err != nil {
+			return err
+		}
+		spool, err := readLeftoverSpool(a.fs, filePath, info, location)
+		if err != nil {
+			return err
+		}
+		log.WithField("file", filePath).Warn("Archiving a rotated log left by a previous run")
+		a.queue(archiveJob{
+			files: []pendingArchive{{src: filePath, dst: a.archivePath(filePath)}},
+			rotation: Rotation{
+				Dir:   a.dir,
+				Start: spool.openTime,
+				End:   spool.closeTime,
+			},
+		})
+	}
+	return nil
+}
+
+// removeTempFiles removes the temporary files espy left in an archive
+// directory when it stopped while writing archives
+func (a *archiver) removeTempFiles(dir string) error {
+	entries, err := afero.ReadDir(a.fs, dir)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !isTempArchive(entry.Name()) {
+			continue
+		}
+		filePath := path.Join(dir, entry.Name())
+		log.WithField("file", filePath).Warn("Removing an archive left half written by a previous run")
+		if err := a.fs.Remove(filePath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fileExists returns true if a file exists at the given path
+func fileExists(fs afero.Fs, filePath string) bool {
+	exists, err := afero.Exists(fs, filePath)
+	return err == nil && exists
+}
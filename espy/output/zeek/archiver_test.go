@@ -0,0 +1,158 @@
+package zeek
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveInBackground(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	w, err := NewRollingWriter(fs, clock, newTestZeekCfg(t), func() {})
+	require.Nil(t, err)
+	writer := w.(*RollingWriter)
+
+	// hold up compression until the test is done writing
+	release := make(chan struct{})
+	writer.archiver.compressor = compressor{
+		extension: ".log.gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			<-release
+			return gzip.NewWriter(w), nil
+		},
+	}
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 3)), "Writing should not wait on compression")
+
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/ecs-spool/pending/2022-02-14/conn.16:00:00-17:00:00.log")
+	require.Nil(t, err)
+	require.True(t, exists, "The rotated spool should wait in the pending directory")
+
+	close(release)
+	require.Nil(t, w.Close())
+	requireArchives(t, fs, "2022-02-14/16:00:00-17:00:00", "2022-02-14/17:00:00-17:00:00")
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.17:00:00-17:00:00.log.gz")
+	require.Contains(t, contents, "\t10.0.0.1\t")
+}
+
+func TestArchiveFailureRetried(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	w, err := NewRollingWriter(fs, clock, newTestZeekCfg(t), func() {})
+	require.Nil(t, err)
+	writer := w.(*RollingWriter)
+	writer.archiver.compressor = compressor{
+		extension: ".log.gz",
+		newWriter: func(io.Writer) (io.WriteCloser, error) { return failingWriter{}, nil },
+	}
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	require.NotNil(t, writer.Ready(context.Background()), "Failed archives should be reported")
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/ecs-spool/pending/2022-02-14/conn.16:00:00-17:00:00.log")
+	require.Nil(t, err)
+	require.True(t, exists, "A log which could not be archived should be kept")
+
+	// the failed logs are archived at the next rotation once archiving works
+	writer.archiver.compressor, err = newCompressor(newTestZeekCfg(t))
+	require.Nil(t, err)
+	clock.Set(time.Date(2022, 02, 14, 18, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	require.Nil(t, writer.Ready(context.Background()), "The writer should be ready once the failed logs are archived")
+	defer w.Close()
+	requireArchives(t, fs, "2022-02-14/16:00:00-17:00:00", "2022-02-14/17:00:00-18:00:00")
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00.log.gz")
+	require.Contains(t, contents, "#close\t2022-02-14-17-00-00\n")
+
+	exists, err = afero.Exists(fs, "/opt/zeek/logs/ecs-spool/pending/2022-02-14/conn.16:00:00-17:00:00.log")
+	require.Nil(t, err)
+	require.False(t, exists, "The pending log should be removed once archived")
+}
+
+func TestRemoveTempArchives(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	// the archive was being written from a pending log when espy stopped
+	pendingPath := "/opt/zeek/logs/ecs-spool/pending/2022-02-14/conn.15:00:00-16:00:00.log"
+	tmpPath := "/opt/zeek/logs/2022-02-14/.espy-conn.15:00:00-16:00:00.log.gz.tmp"
+	keptPaths := []string{
+		"/opt/zeek/logs/2022-02-14/notes.tmp",
+		"/opt/zeek/logs/2022-02-14/.conn.15:00:00-16:00:00.log.gz.tmp",
+		"/opt/zeek/logs/2022-02-13/.espy-conn.15:00:00-16:00:00.log.gz.tmp",
+	}
+	require.Nil(t, afero.WriteFile(fs, pendingPath, []byte("#open\t2022-02-14-15-00-00\n"), 0644))
+	require.Nil(t, afero.WriteFile(fs, tmpPath, []byte("partial"), 0644))
+	for _, keptPath := range keptPaths {
+		require.Nil(t, afero.WriteFile(fs, keptPath, []byte("notes"), 0644))
+	}
+
+	w, err := NewRollingWriter(fs, clock, newTestZeekCfg(t), func() {})
+	require.Nil(t, err)
+	defer w.Close()
+
+	exists, err := afero.Exists(fs, tmpPath)
+	require.Nil(t, err)
+	require.False(t, exists, "A half written archive should be removed on startup")
+	for _, keptPath := range keptPaths {
+		exists, err = afero.Exists(fs, keptPath)
+		require.Nil(t, err)
+		require.True(t, exists, "Files espy did not leave behind while archiving should be left alone: %s", keptPath)
+	}
+}
+
+// badWriter fails to write anything containing "bad"
+type badWriter struct {
+	io.WriteCloser
+}
+
+func (w badWriter) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), "bad") {
+		return 0, errors.New("disk full")
+	}
+	return w.WriteCloser.Write(p)
+}
+
+func TestArchiveFailureKeepsReadyFailing(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	compressor := compressor{
+		extension: ".log.gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) { return badWriter{gzip.NewWriter(w)}, nil },
+	}
+	a := newArchiver(fs, "/logs", "/logs/ecs-spool/pending", compressor, nil)
+	defer a.close()
+	stage := func(name, contents string) archiveJob {
+		pending := "/logs/ecs-spool/pending/2022-02-14/" + name + ".log"
+		require.Nil(t, afero.WriteFile(fs, pending, []byte(contents), 0644))
+		return archiveJob{files: []pendingArchive{{src: pending, dst: a.archivePath(pending)}}}
+	}
+
+	a.queue(stage("conn.15:00:00-16:00:00", "bad"))
+	a.flush()
+	require.NotNil(t, a.err())
+
+	a.queue(stage("conn.16:00:00-17:00:00", "good"))
+	a.flush()
+	require.NotNil(t, a.err(), "A later archive should not hide a log which is still waiting to be archived")
+	require.True(t, fileExists(fs, "/logs/2022-02-14/conn.16:00:00-17:00:00.log.gz"))
+
+	// the failed log is retried before the next rotation is archived
+	require.Nil(t, afero.WriteFile(fs, "/logs/ecs-spool/pending/2022-02-14/conn.15:00:00-16:00:00.log", []byte("fixed"), 0644))
+	a.queue(stage("conn.17:00:00-18:00:00", "good"))
+	a.flush()
+	require.Nil(t, a.err())
+	require.True(t, fileExists(fs, "/logs/2022-02-14/conn.15:00:00-16:00:00.log.gz"))
+	require.False(t, fileExists(fs, "/logs/ecs-spool/pending/2022-02-14/conn.15:00:00-16:00:00.log"))
+}
@@ -0,0 +1,68 @@
+package zeek
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// Compression methods supported for archived Zeek logs
+const (
+	CompressionGzip = "gzip"
+	CompressionZstd = "zstd"
+	CompressionNone = "none"
+)
+
+// compressor compresses spool files into archives
+type compressor struct {
+	// extension is appended to the name of each archive
+	extension string
+	// newWriter wraps the archive file with a compressing writer.
+	// Spool files are moved into place if it is nil.
+	newWriter func(io.Writer) (io.WriteCloser, error)
+}
+
+// newCompressor returns the compressor for the Compression and
+// CompressionLevel settings of a Zeek output. A level of zero selects
+// the default level of the compression method.
+func newCompressor(zeekCfg config.ZeekCfg) (compressor, error) {
+	level := zeekCfg.CompressionLevel
+	switch zeekCfg.Compression {
+	case CompressionGzip:
+		if level == 0 {
+			level = gzip.DefaultCompression
+		} else if level < gzip.BestSpeed || level > gzip.BestCompression {
+			return compressor{}, fmt.Errorf("the gzip CompressionLevel must be between %d and %d, got %d", gzip.BestSpeed, gzip.BestCompression, level)
+		}
+		return compressor{
+			extension: ".log.gz",
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return gzip.NewWriterLevel(w, level)
+			},
+		}, nil
+	case CompressionZstd:
+		options := []zstd.EOption{}
+		if level != 0 {
+			if level < 1 || level > 22 {
+				return compressor{}, fmt.Errorf("the zstd CompressionLevel must be between 1 and 22, got %d", level)
+			}
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		return compressor{
+			extension: ".log.zst",
+			newWriter: func(w io.Writer) (io.WriteCloser, error) {
+				return zstd.NewWriter(w, options...)
+			},
+		}, nil
+	case CompressionNone:
+		if level != 0 {
+			return compressor{}, fmt.Errorf("CompressionLevel cannot be set without compression")
+		}
+		return compressor{extension: ".log"}, nil
+	}
+	return compressor{}, fmt.Errorf("unknown Zeek Compression %q, expected %s, %s or %s", zeekCfg.Compression, CompressionGzip, CompressionZstd, CompressionNone)
+}
@@ -0,0 +1,104 @@
+package zeek
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/klauspost/compress/zstd"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveCompression(t *testing.T) {
+	contents := "#separator \\x09\n1644855438.000000\t-\t10.0.0.1\n"
+	readers := map[string]func(io.Reader) (io.Reader, error){
+		CompressionGzip: func(r io.Reader) (io.Reader, error) { return gzip.NewReader(r) },
+		CompressionZstd: func(r io.Reader) (io.Reader, error) { return zstd.NewReader(r) },
+		CompressionNone: func(r io.Reader) (io.Reader, error) { return r, nil },
+	}
+	extensions := map[string]string{
+		CompressionGzip: ".log.gz",
+		CompressionZstd: ".log.zst",
+		CompressionNone: ".log",
+	}
+
+	for method, newReader := range readers {
+		fs := afero.NewMemMapFs()
+		require.Nil(t, afero.WriteFile(fs, "/spool/conn.log", []byte(contents), 0644))
+
+		zeekCfg := newTestZeekCfg(t)
+		zeekCfg.Compression = method
+		compressor, err := newCompressor(zeekCfg)
+		require.Nil(t, err, method)
+		require.Equal(t, extensions[method], compressor.extension, method)
+
+		archivePath := "/logs/conn" + compressor.extension
+		written, size, err := compressor.archiveFile(fs, "/spool/conn.log", archivePath)
+		require.Nil(t, err, method)
+		require.Equal(t, archivePath, written, method)
+		require.Equal(t, int64(len(contents)), size, method)
+
+		exists, err := afero.Exists(fs, "/spool/conn.log")
+		require.Nil(t, err)
+		require.False(t, exists, "The %s spool file should be removed", method)
+
+		archive, err := fs.Open(archivePath)
+		require.Nil(t, err, method)
+		reader, err := newReader(archive)
+		require.Nil(t, err, method)
+		archived, err := ioutil.ReadAll(reader)
+		require.Nil(t, err, method)
+		require.Equal(t, contents, string(archived), method)
+		archive.Close()
+	}
+}
+
+func TestCompressionSettings(t *testing.T) {
+	zeekCfg := newTestZeekCfg(t)
+	require.Equal(t, CompressionGzip, zeekCfg.Compression, "Logs should be gzipped by default")
+
+	zeekCfg.CompressionLevel = gzip.BestCompression
+	_, err := newCompressor(zeekCfg)
+	require.Nil(t, err)
+
+	zeekCfg.CompressionLevel = 12
+	_, err = newCompressor(zeekCfg)
+	require.NotNil(t, err, "gzip levels only go up to 9")
+
+	zeekCfg.Compression = CompressionZstd
+	_, err = newCompressor(zeekCfg)
+	require.Nil(t, err, "zstd levels go up to 22")
+
+	zeekCfg.Compression = CompressionNone
+	_, err = newCompressor(zeekCfg)
+	require.NotNil(t, err, "A level should not be accepted without compression")
+
+	zeekCfg.Compression = "bzip2"
+	zeekCfg.CompressionLevel = 0
+	_, err = newCompressor(zeekCfg)
+	require.NotNil(t, err)
+}
+
+func TestRollingZstd(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.Compression = CompressionZstd
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	defer w.Close()
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	for _, zeekFileType := range RegisteredTSVFileTypes {
+		archivePath := "/opt/zeek/logs/2022-02-14/" + zeekFileType.Header().Path + ".16:00:00-17:00:00.log.zst"
+		exists, err := afero.Exists(fs, archivePath)
+		require.Nil(t, err)
+		require.True(t, exists, archivePath+" should exist")
+	}
+}
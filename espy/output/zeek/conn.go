@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/activecm/espy/espy/input"
 )
@@ -40,9 +39,9 @@ func (c ConnTSV) FormatLines(outputData []input.ECSRecord) (output string, err e
 	separator, _ := strconv.Unquote(fmt.Sprintf("\"%s\"", header.Separator))
 
 	for i := range outputData {
-		goStartTime, err := time.Parse(time.RFC3339Nano, outputData[i].RFCTimestamp)
+		goStartTime, err := outputData[i].Time()
 		if err != nil {
-			return output, input.ErrMalformedECSRecord
+			return output, err
 		}
 
 		// from Sam: WARNING the way we handle data in RITA uses a floating time and splits
@@ -51,7 +50,7 @@ func (c ConnTSV) FormatLines(outputData []input.ECSRecord) (output string, err e
 		//  can be changed
 
 		values := []string{
-			fmt.Sprintf("%.6f", float64(goStartTime.UnixNano())/1e9), // "ts"
+			strconv.FormatFloat(float64(goStartTime.UnixNano())/1e9, 'f', 6, 64), // "ts"
 			header.UnsetField,                       // "uid"
 			outputData[i].Source.IP,                 // "id.orig_h"
 			outputData[i].Source.Port.String(),      // "id.orig_p"
@@ -0,0 +1,11 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package zeek
+
+import "errors"
+
+// diskFreePercent is not supported on this platform
+func diskFreePercent(directory string) (float64, error) {
+	return 0, errors.New("checking free disk space is not supported on this platform")
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+// +build linux darwin freebsd
+
+package zeek
+
+import "syscall"
+
+// diskFreePercent returns the percentage of the disk holding
+// the given directory which is available for writing
+func diskFreePercent(directory string) (float64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(directory, &stat); err != nil {
+		return 0, err
+	}
+	if stat.Blocks == 0 {
+		return 100, nil
+	}
+	return float64(stat.Bavail) / float64(stat.Blocks) * 100, nil
+}
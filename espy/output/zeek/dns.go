@@ -4,7 +4,6 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
-	"time"
 
 	"github.com/activecm/espy/espy/input"
 	"github.com/activecm/espy/espy/util"
@@ -125,9 +124,9 @@ func (c DnsTSV) FormatLines(outputData []input.ECSRecord) (output string, err er
 	separator, _ := strconv.Unquote(fmt.Sprintf("\"%s\"", header.Separator))
 
 	for i := range outputData {
-		goStartTime, err := time.Parse(time.RFC3339Nano, outputData[i].RFCTimestamp)
+		goStartTime, err := outputData[i].Time()
 		if err != nil {
-			return output, input.ErrMalformedECSRecord
+			return output, err
 		}
 
 		answersSetBuilder := strings.Builder{}
@@ -171,7 +170,7 @@ func (c DnsTSV) FormatLines(outputData []input.ECSRecord) (output string, err er
 
 		for _, sourceIP := range util.SelectPublicPrivateIPs(outputData[i].Host.IP) {
 			values := []string{
-				fmt.Sprintf("%.6f", float64(goStartTime.UnixNano())/1e9), // "ts"
+				strconv.FormatFloat(float64(goStartTime.UnixNano())/1e9, 'f', 6, 64), // "ts"
 				header.UnsetField,               // "uid"
 				sourceIP,                        // "id.orig_h"
 				header.UnsetField,               // "id.orig_p"
@@ -0,0 +1,241 @@
+package zeek
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// hookQueueSize is the number of rotations which may wait for
+// the hooks to finish before later rotations are skipped
+const hookQueueSize = 64
+
+// hookCloseTimeout bounds how long closing a writer waits for its hooks
+// before the hooks still running are cancelled and the rest are skipped,
+// so slow hooks cannot hold up a shutdown or a configuration reload
+const hookCloseTimeout = 10 * time.Second
+
+// Rotation describes the archives written by a log rotation.
+// It is the JSON body sent to webhooks.
+type Rotation struct {
+	// Dir is the Zeek log directory the archives were written to
+	Dir string `json:"dir"`
+	// Start and End are the bounds of the period the archives cover
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	// Archives are the paths of the archives which were written
+	Archives []string `json:"archives"`
+	// Early is set if the archives were rotated before the end
+	// of the period because they reached the size or line limit
+	Early bool `json:"early"`
+}
+
+// env returns the environment variables describing the rotation
+// to a hook command
+func (r Rotation) env() []string {
+	return []string{
+		"ESPY_ARCHIVE_DIR=" + r.Dir,
+		"ESPY_ARCHIVES=" + strings.Join(r.Archives, " "),
+		"ESPY_PERIOD_START=" + r.Start.Format(time.RFC3339),
+		"ESPY_PERIOD_END=" + r.End.Format(time.RFC3339),
+		fmt.Sprintf("ESPY_EARLY=%t", r.Early),
+	}
+}
+
+// hookRunner runs the configured hooks for each rotation in the
+// background, one rotation at a time and in the order they happened
+type hookRunner struct {
+	hooks     []config.HookCfg
+	client    *http.Client
+	crashFunc func()
+
+	queue   chan Rotation
+	done    chan struct{}
+	closing sync.Once
+	// ctx is cancelled when the hooks take too long to finish on close
+	ctx          context.Context
+	cancel       context.CancelFunc
+	closeTimeout time.Duration
+}
+
+// newHookRunner starts a hookRunner for the given hooks,
+// or returns nil if there are none
+func newHookRunner(hooks []config.HookCfg, crashFunc func()) *hookRunner {
+	if len(hooks) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &hookRunner{
+		hooks:        hooks,
+		client:       &http.Client{},
+		crashFunc:    crashFunc,
+		queue:        make(chan Rotation, hookQueueSize),
+		done:         make(chan struct{}),
+		ctx:          ctx,
+		cancel:       cancel,
+		closeTimeout: hookCloseTimeout,
+	}
+	go r.run()
+	return r
+}
+
+// notify queues the hooks to run for a rotation without waiting for them
+func (r *hookRunner) notify(rotation Rotation) {
+	select {
+	case r.queue <- rotation:
+	default:
+		log.WithField("archives", rotation.Archives).
+			Error("Skipping the rotation hooks since too many rotations are waiting on them")
+	}
+}
+
+// close waits up to closeTimeout for the hooks of the rotations already
+// queued to finish, then cancels the hooks which are still running and
+// skips those which have not started
+func (r *hookRunner) close() {
+	r.closing.Do(func() { close(r.queue) })
+	timer := time.NewTimer(r.closeTimeout)
+	defer timer.Stop()
+	select {
+	case <-r.done:
+	case <-timer.C:
+		log.Warnf("Rotation hooks did not finish within %s, cancelling them", r.closeTimeout)
+		r.cancel()
+		<-r.done
+	}
+	r.cancel()
+}
+
+func (r *hookRunner) run() {
+	defer close(r.done)
+	for rotation := range r.queue {
+		if r.ctx.Err() != nil {
+			log.WithField("archives", rotation.Archives).Warn("Skipping the rotation hooks since espy is shutting down")
+			continue
+		}
+		for i := range r.hooks {
+			r.runWithRetries(r.hooks[i], rotation)
+		}
+	}
+}
+
+// runWithRetries runs a hook until it succeeds or runs out of
+// retries, then applies its failure policy
+func (r *hookRunner) runWithRetries(hook config.HookCfg, rotation Rotation) {
+	var err error
+	for attempt := 0; attempt <= hook.Retries; attempt++ {
+		if attempt > 0 && !r.wait(hook.RetryDelay) {
+			break
+		}
+		err = r.runHook(hook, rotation)
+		if err == nil {
+			log.WithFields(log.Fields{
+				"hook":     hook.Name,
+				"archives": rotation.Archives,
+			}).Info("Ran rotation hook")
+			return
+		}
+		log.WithError(err).WithFields(log.Fields{
+			"hook":    hook.Name,
+			"attempt": attempt + 1,
+		}).Warn("Rotation hook failed")
+		if r.ctx.Err() != nil {
+			break
+		}
+	}
+
+	if r.ctx.Err() != nil {
+		log.WithError(err).
+			WithField("hook", hook.Name).
+			WithField("archives", rotation.Archives).
+			Warn("Cancelled rotation hook since espy is shutting down")
+		return
+	}
+	if hook.OnFailure == config.HookFailureStop {
+		log.WithError(err).
+			WithField("hook", hook.Name).
+			WithField("fatal", true).
+			Error("Stopping since the rotation hook failed")
+		r.crashFunc()
+		return
+	}
+	log.WithError(err).
+		WithField("hook", hook.Name).
+		WithField("archives", rotation.Archives).
+		Error("Giving up on rotation hook")
+}
+
+// wait sleeps for the given delay, returning false if
+// the hooks were cancelled in the meantime
+func (r *hookRunner) wait(delay time.Duration) bool {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
+
+// runHook makes a single attempt at running a hook
+func (r *hookRunner) runHook(hook config.HookCfg, rotation Rotation) error {
+	ctx, cancel := context.WithTimeout(r.ctx, hook.Timeout)
+	defer cancel()
+	if hook.URL != "" {
+		return r.postWebhook(ctx, hook, rotation)
+	}
+	return runCommand(ctx, hook, rotation)
+}
+
+// runCommand runs a hook's command with the archive paths appended to its
+// arguments and the rotation described in its environment
+func runCommand(ctx context.Context, hook config.HookCfg, rotation Rotation) error {
+	args := append(append([]string{}, hook.Command[1:]...), rotation.Archives...)
+	cmd := exec.CommandContext(ctx, hook.Command[0], args...)
+	cmd.Env = append(os.Environ(), rotation.env()...)
+	// stop waiting on the output of any programs the command started
+	// once the command itself has been killed
+	cmd.WaitDelay = time.Second
+	output, err := cmd.CombinedOutput()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %s", hook.Timeout)
+	}
+	if err != nil {
+		return fmt.Errorf("%v: %s", err, bytes.TrimSpace(output))
+	}
+	return nil
+}
+
+// postWebhook sends the rotation to a hook's URL as JSON
+func (r *hookRunner) postWebhook(ctx context.Context, hook config.HookCfg, rotation Rotation) error {
+	body, err := json.Marshal(rotation)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded with %s", hook.URL, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,144 @@
+package zeek
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/creasty/defaults"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+func newTestHook(t *testing.T) config.HookCfg {
+	hook := config.HookCfg{Name: "test"}
+	require.Nil(t, defaults.Set(&hook))
+	hook.RetryDelay = 0
+	return hook
+}
+
+func TestCommandHook(t *testing.T) {
+	outFile := filepath.Join(t.TempDir(), "hook.out")
+	hook := newTestHook(t)
+	hook.Command = []string{"/bin/sh", "-c", `echo "$ESPY_PERIOD_START $ESPY_PERIOD_END $ESPY_EARLY $*" >> ` + outFile, "hook"}
+
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.Hooks = []config.HookCfg{hook}
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	require.Nil(t, w.Close())
+
+	output, err := ioutil.ReadFile(outFile)
+	require.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	require.Equal(t, []string{
+		"2022-02-14T16:00:00Z 2022-02-14T17:00:00Z false " +
+			"/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00.log.gz /opt/zeek/logs/2022-02-14/dns.16:00:00-17:00:00.log.gz",
+		"2022-02-14T17:00:00Z 2022-02-14T17:00:00Z false " +
+			"/opt/zeek/logs/2022-02-14/conn.17:00:00-17:00:00.log.gz /opt/zeek/logs/2022-02-14/dns.17:00:00-17:00:00.log.gz",
+	}, lines, "The hook should run for the scheduled rotation and when the writer is closed")
+}
+
+func TestWebhook(t *testing.T) {
+	var mutex sync.Mutex
+	var rotations []Rotation
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		attempts++
+		if attempts == 1 {
+			rw.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var rotation Rotation
+		require.Nil(t, json.NewDecoder(req.Body).Decode(&rotation))
+		rotations = append(rotations, rotation)
+	}))
+	defer server.Close()
+
+	hook := newTestHook(t)
+	hook.URL = server.URL
+	hook.Retries = 1
+
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLines = 2
+	zeekCfg.Hooks = []config.HookCfg{hook}
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	require.Nil(t, w.(*RollingWriter).WriteECSRecords(testConnRecords(clock, 2)))
+	require.Nil(t, w.Close())
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	require.Equal(t, 3, attempts, "The failed webhook should be retried")
+	require.Len(t, rotations, 2)
+	require.True(t, rotations[0].Early)
+	require.Equal(t, []string{"/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00.1.log.gz"}, rotations[0].Archives)
+	require.False(t, rotations[1].Early)
+	require.Len(t, rotations[1].Archives, len(RegisteredTSVFileTypes))
+}
+
+func TestHookFailurePolicy(t *testing.T) {
+	for policy, crashes := range map[string]bool{config.HookFailureLog: false, config.HookFailureStop: true} {
+		hook := newTestHook(t)
+		hook.Command = []string{"/bin/sh", "-c", "exit 1"}
+		hook.OnFailure = policy
+
+		crashed := false
+		runner := newHookRunner([]config.HookCfg{hook}, func() { crashed = true })
+		runner.notify(Rotation{Archives: []string{"conn.log.gz"}})
+		runner.close()
+		require.Equal(t, crashes, crashed, policy)
+	}
+}
+
+func TestHookTimeout(t *testing.T) {
+	hook := newTestHook(t)
+	hook.Command = []string{"/bin/sh", "-c", "sleep 5"}
+	hook.Timeout = 50 * time.Millisecond
+
+	runner := &hookRunner{ctx: context.Background()}
+	start := time.Now()
+	err := runner.runHook(hook, Rotation{})
+	require.NotNil(t, err)
+	require.Less(t, int64(time.Since(start)), int64(2*time.Second), "The hook should be killed once it times out")
+}
+
+func TestHookCloseTimeout(t *testing.T) {
+	hook := newTestHook(t)
+	hook.Command = []string{"/bin/sh", "-c", "sleep 5; exit 1"}
+	hook.Retries = 3
+	hook.RetryDelay = time.Minute
+	hook.OnFailure = config.HookFailureStop
+
+	crashed := false
+	runner := newHookRunner([]config.HookCfg{hook}, func() { crashed = true })
+	runner.closeTimeout = 50 * time.Millisecond
+	runner.notify(Rotation{Archives: []string{"conn.1.log.gz"}})
+	runner.notify(Rotation{Archives: []string{"conn.2.log.gz"}})
+
+	start := time.Now()
+	runner.close()
+	require.Less(t, int64(time.Since(start)), int64(2*time.Second), "Closing should not wait on hooks for longer than the close timeout")
+	require.False(t, crashed, "A hook cancelled by closing should not apply its failure policy")
+}
@@ -0,0 +1,276 @@
+package zeek
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// pruneInterval is how often the janitor checks the retention policies
+const pruneInterval = 10 * time.Minute
+
+// janitor deletes the archives written by espy to the oldest dated
+// directories once they break the configured retention policies. Only the
+// archives listed in the manifest of a directory are deleted, so logs
+// written there by Zeek or anything else are kept. The newest directory
+// is never pruned since it may still be written to.
+type janitor struct {
+	fs    afero.Fs
+	clock clock.Clock
+	// dirs are the archive directories holding the dated directories.
+	// There is more than one if the janitor looks after several partitions.
+	dirs      []string
+	maxAge    int
+	maxBytes  int64
+	minFree   float64
+	freeSpace func(directory string) (float64, error)
+
+	mutex   sync.Mutex
+	timer   *clock.Timer
+	stopped bool
+}
+
+// archiveDir is a dated directory of archived logs
+type archiveDir struct {
+	root string
+	name string
+	date time.Time
+	// archives are the files espy wrote to the directory
+	// relative to it, as listed in its manifest
+	archives []string
+	size     int64
+}
+
+// newJanitor returns a janitor enforcing the retention policies in the
+// Zeek config, or nil if no policies are set
+func newJanitor(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg) *janitor {
+	if zeekCfg.RetentionDays == 0 && zeekCfg.RetentionSize == 0 && zeekCfg.MinFreePercent == 0 {
+		return nil
+	}
+	return &janitor{
+		fs:        fs,
+		clock:     clock,
+		dirs:      []string{zeekCfg.OutputPath},
+		maxAge:    zeekCfg.RetentionDays,
+		maxBytes:  int64(zeekCfg.RetentionSize),
+		minFree:   zeekCfg.MinFreePercent,
+		freeSpace: diskFreePercent,
+	}
+}
+
+// start prunes the archives right away and then every pruneInterval
+func (j *janitor) start() {
+	log.WithFields(log.Fields{
+		"dir":              strings.Join(j.dirs, ", "),
+		"retention_days":   j.maxAge,
+		"retention_size":   j.maxBytes,
+		"min_free_percent": j.minFree,
+	}).Info("Deleting old Zeek logs according to the retention policies")
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.timer = j.clock.AfterFunc(0, j.run)
+}
+
+// stop cancels any future pruning
+func (j *janitor) stop() {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.stopped = true
+	if j.timer != nil {
+		j.timer.Stop()
+	}
+}
+
+func (j *janitor) run() {
+	j.prune()
+
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if !j.stopped {
+		j.timer = j.clock.AfterFunc(pruneInterval, j.run)
+	}
+}
+
+// prune deletes the archives in the oldest dated directories until
+// the archives meet the retention policies
+func (j *janitor) prune() {
+	dirs, err := j.archiveDirs()
+	if err != nil {
+		log.WithError(err).WithField("dir", strings.Join(j.dirs, ", ")).Error("Could not list the archived Zeek logs")
+		return
+	}
+
+	if j.maxAge > 0 {
+		now := j.clock.Now()
+		today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+		cutoff := today.AddDate(0, 0, -j.maxAge)
+		for len(dirs) > 1 && dirs[0].date.Before(cutoff) {
+			if !j.remove(dirs[0], "older than RetentionDays") {
+				return
+			}
+			dirs = dirs[1:]
+		}
+	}
+
+	if j.maxBytes > 0 {
+		var total int64
+		for i := range dirs {
+			total += dirs[i].size
+		}
+		for len(dirs) > 1 && total > j.maxBytes {
+			if !j.remove(dirs[0], "archives larger than RetentionSize") {
+				return
+			}
+			total -= dirs[0].size
+			dirs = dirs[1:]
+		}
+		if total > j.maxBytes {
+			log.WithFields(log.Fields{
+				"dir":  strings.Join(j.dirs, ", "),
+				"size": total,
+			}).Warn("The newest Zeek logs alone are larger than RetentionSize")
+		}
+	}
+
+	if j.minFree > 0 {
+		for {
+			free, err := j.freeSpace(j.dirs[0])
+			if err != nil {
+				log.WithError(err).WithField("dir", j.dirs[0]).Error("Could not check the free disk space")
+				return
+			}
+			if free >= j.minFree {
+				break
+			}
+			if len(dirs) <= 1 {
+				log.WithFields(log.Fields{
+					"dir":          strings.Join(j.dirs, ", "),
+					"free_percent": free,
+				}).Warn("The disk is below MinFreePercent and there are no old Zeek logs left to delete")
+				break
+			}
+			if !j.remove(dirs[0], "disk below MinFreePercent") {
+				return
+			}
+			dirs = dirs[1:]
+		}
+	}
+}
+
+// remove deletes the archives espy wrote to a dated directory along with
+// its manifest, and then the directory itself if nothing else is left in it.
+// It returns false if the archives could not be deleted.
+func (j *janitor) remove(dir archiveDir, reason string) bool {
+	dirPath := path.Join(dir.root, dir.name)
+	for _, archive := range dir.archives {
+		archivePath := path.Join(dirPath, archive)
+		if err := j.fs.Remove(archivePath); err != nil && !os.IsNotExist(err) {
+			log.WithError(err).WithField("file", archivePath).Error("Could not delete old Zeek logs")
+			return false
+		}
+	}
+	if err := j.fs.Remove(path.Join(dirPath, archiveManifest)); err != nil && !os.IsNotExist(err) {
+		log.WithError(err).WithField("dir", dirPath).Error("Could not delete old Zeek logs")
+		return false
+	}
+	removeEmptyDirs(j.fs, dirPath)
+
+	log.WithFields(log.Fields{
+		"dir":    dirPath,
+		"size":   dir.size,
+		"files":  len(dir.archives),
+		"reason": reason,
+	}).Warn("Deleted old Zeek logs")
+	return true
+}
+
+// archiveDirs lists the dated directories espy has written archives to,
+// oldest first. Sizes are only totalled if RetentionSize is set.
+func (j *janitor) archiveDirs() ([]archiveDir, error) {
+	var dirs []archiveDir
+	for _, root := range j.dirs {
+		entries, err := afero.ReadDir(j.fs, root)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				continue
+			}
+			date, err := time.ParseInLocation("2006-01-02", entry.Name(), j.clock.Now().Location())
+			if err != nil {
+				continue
+			}
+			dir := archiveDir{root: root, name: entry.Name(), date: date}
+			dir.archives, err = readManifest(j.fs, path.Join(root, entry.Name()))
+			if os.IsNotExist(err) {
+				// espy never archived anything here
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+			if j.maxBytes > 0 {
+				for _, archive := range dir.archives {
+					if info, err := j.fs.Stat(path.Join(root, entry.Name(), archive)); err == nil {
+						dir.size += info.Size()
+					}
+				}
+			}
+			dirs = append(dirs, dir)
+		}
+	}
+	sort.SliceStable(dirs, func(a, b int) bool { return dirs[a].date.Before(dirs[b].date) })
+	return dirs, nil
+}
+
+// readManifest returns the archives listed in the manifest of a dated
+// directory, relative to the directory
+func readManifest(fs afero.Fs, dirPath string) ([]string, error) {
+	file, err := fs.Open(path.Join(dirPath, archiveManifest))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var archives []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		archive := path.Clean(scanner.Text())
+		// never follow an entry out of the directory
+		if archive == "." || path.IsAbs(archive) || strings.HasPrefix(archive, "..") {
+			continue
+		}
+		archives = append(archives, archive)
+	}
+	return archives, scanner.Err()
+}
+
+// removeEmptyDirs removes a directory and any directories under it
+// which are empty, deepest first
+func removeEmptyDirs(fs afero.Fs, dirPath string) {
+	var dirs []string
+	afero.Walk(fs, dirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			dirs = append(dirs, filePath)
+		}
+		return nil
+	})
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if empty, err := afero.IsEmpty(fs, dirs[i]); err == nil && empty {
+			fs.Remove(dirs[i])
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package zeek
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestJanitor(t *testing.T, days []string, size int) (afero.Fs, *clock.Mock) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	for _, day := range days {
+		writeTestArchive(t, fs, "/opt/zeek/logs", day, size)
+	}
+	require.Nil(t, fs.MkdirAll("/opt/zeek/logs/ecs-spool", 0755))
+	return fs, clock
+}
+
+// writeTestArchive writes an archive to a dated directory and lists it in
+// the directory's manifest as though espy had archived it
+func writeTestArchive(t *testing.T, fs afero.Fs, root, day string, size int) {
+	archive := path.Join(root, day, "conn.00:00:00-01:00:00.log.gz")
+	require.Nil(t, afero.WriteFile(fs, archive, make([]byte, size), 0644))
+	require.Nil(t, afero.WriteFile(fs, path.Join(root, day, archiveManifest), []byte("conn.00:00:00-01:00:00.log.gz\n"), 0644))
+}
+
+func requireDays(t *testing.T, fs afero.Fs, days ...string) {
+	entries, err := afero.ReadDir(fs, "/opt/zeek/logs")
+	require.Nil(t, err)
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	require.ElementsMatch(t, append(days, "ecs-spool"), names)
+}
+
+func TestJanitorRetentionDays(t *testing.T) {
+	fs, clock := newTestJanitor(t, []string{"2022-02-10", "2022-02-11", "2022-02-12", "2022-02-13", "2022-02-14"}, 10)
+	j := &janitor{fs: fs, clock: clock, dirs: []string{"/opt/zeek/logs"}, maxAge: 2}
+	j.prune()
+	requireDays(t, fs, "2022-02-12", "2022-02-13", "2022-02-14")
+}
+
+func TestJanitorRetentionSize(t *testing.T) {
+	fs, clock := newTestJanitor(t, []string{"2022-02-11", "2022-02-12", "2022-02-13", "2022-02-14"}, 100)
+	j := &janitor{fs: fs, clock: clock, dirs: []string{"/opt/zeek/logs"}, maxBytes: 250}
+	j.prune()
+	requireDays(t, fs, "2022-02-13", "2022-02-14")
+
+	// the newest directory is kept even if it is over the limit alone
+	j.maxBytes = 50
+	j.prune()
+	requireDays(t, fs, "2022-02-14")
+}
+
+func TestJanitorMinFree(t *testing.T) {
+	fs, clock := newTestJanitor(t, []string{"2022-02-11", "2022-02-12", "2022-02-13", "2022-02-14"}, 10)
+	free := 0.0
+	j := &janitor{
+		fs:      fs,
+		clock:   clock,
+		dirs:    []string{"/opt/zeek/logs"},
+		minFree: 5,
+		freeSpace: func(string) (float64, error) {
+			free += 2
+			return free, nil
+		},
+	}
+	j.prune()
+	requireDays(t, fs, "2022-02-13", "2022-02-14")
+}
+
+func TestJanitorSchedule(t *testing.T) {
+	fs, clock := newTestJanitor(t, []string{"2022-02-12", "2022-02-13", "2022-02-14"}, 10)
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RetentionDays = 1
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	clock.Add(0)
+	requireDays(t, fs, "2022-02-13", "2022-02-14")
+
+	// the next day's directory is created by the midnight rotation
+	// and the janitor removes the 13th on its next pass after midnight
+	clock.Set(time.Date(2022, 02, 15, 0, 5, 0, 0, time.UTC))
+	requireDays(t, fs, "2022-02-13", "2022-02-14")
+	clock.Add(pruneInterval)
+	requireDays(t, fs, "2022-02-14")
+
+	require.Nil(t, w.Close())
+	require.Nil(t, fs.MkdirAll("/opt/zeek/logs/2022-02-01", 0755))
+	clock.Add(24 * time.Hour)
+	requireDays(t, fs, "2022-02-01", "2022-02-14", "2022-02-15")
+}
+
+func TestJanitorKeepsOtherLogs(t *testing.T) {
+	fs, clock := newTestJanitor(t, []string{"2022-02-12", "2022-02-13", "2022-02-14"}, 10)
+	// Zeek writes its own logs to the same dated directories
+	zeekLogs := []string{
+		"/opt/zeek/logs/2022-02-11/conn.00:00:00-01:00:00.log.gz",
+		"/opt/zeek/logs/2022-02-12/dns.00:00:00-01:00:00.log.gz",
+	}
+	for _, zeekLog := range zeekLogs {
+		require.Nil(t, afero.WriteFile(fs, zeekLog, []byte("zeek"), 0644))
+	}
+
+	j := &janitor{fs: fs, clock: clock, dirs: []string{"/opt/zeek/logs"}, maxAge: 1}
+	j.prune()
+	requireDays(t, fs, "2022-02-11", "2022-02-12", "2022-02-13", "2022-02-14")
+	for _, zeekLog := range zeekLogs {
+		exists, err := afero.Exists(fs, zeekLog)
+		require.Nil(t, err)
+		require.True(t, exists, "Logs espy did not write should never be deleted: %s", zeekLog)
+	}
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-12/conn.00:00:00-01:00:00.log.gz")
+	require.Nil(t, err)
+	require.False(t, exists, "Espy's archives should still be deleted")
+}
+
+func TestJanitorPartitionsShareMinFree(t *testing.T) {
+	fs, clock := newTestJanitor(t, nil, 0)
+	writeTestArchive(t, fs, "/opt/zeek/logs/dmz", "2022-02-11", 10)
+	writeTestArchive(t, fs, "/opt/zeek/logs/dmz", "2022-02-14", 10)
+	writeTestArchive(t, fs, "/opt/zeek/logs/default", "2022-02-12", 10)
+	writeTestArchive(t, fs, "/opt/zeek/logs/default", "2022-02-13", 10)
+	free := 0.0
+	j := &janitor{
+		fs:      fs,
+		clock:   clock,
+		dirs:    []string{"/opt/zeek/logs/dmz", "/opt/zeek/logs/default"},
+		minFree: 5,
+		freeSpace: func(string) (float64, error) {
+			free += 2
+			return free, nil
+		},
+	}
+	j.prune()
+
+	// the two oldest days are deleted, whichever partition they belong to
+	for dir, exists := range map[string]bool{
+		"/opt/zeek/logs/dmz/2022-02-11":     false,
+		"/opt/zeek/logs/default/2022-02-12": false,
+		"/opt/zeek/logs/default/2022-02-13": true,
+		"/opt/zeek/logs/dmz/2022-02-14":     true,
+	} {
+		found, err := afero.DirExists(fs, dir)
+		require.Nil(t, err)
+		require.Equal(t, exists, found, dir)
+	}
+}
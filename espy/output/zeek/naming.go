@@ -0,0 +1,140 @@
+package zeek
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"strings"
+	"text/template"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// Archive naming presets
+const (
+	// ArchiveNameZeekctl names archives like zeekctl does,
+	// such as 2022-02-14/conn.16:00:00-17:00:00.log.gz
+	ArchiveNameZeekctl = "zeekctl"
+	// ArchiveNameZeekctlNoColon is the zeekctl layout without colons,
+	// such as 2022-02-14/conn.16-00-00_17-00-00.log.gz
+	ArchiveNameZeekctlNoColon = "zeekctl-nocolon"
+)
+
+var archiveNamePresets = map[string]string{
+	ArchiveNameZeekctl:        `{{.Start.Format "2006-01-02"}}/{{.Path}}.{{.Start.Format "15:04:05"}}-{{.End.Format "15:04:05"}}`,
+	ArchiveNameZeekctlNoColon: `{{.Start.Format "2006-01-02"}}/{{.Path}}.{{.Start.Format "15-04-05"}}_{{.End.Format "15-04-05"}}`,
+}
+
+// defaultArchiveAgent is the Agent of archives which are not partitioned.
+// A fixed name keeps the archive names stable, unlike the hostname which
+// changes whenever a container is recreated.
+const defaultArchiveAgent = "espy"
+
+var zeekctlTemplate = template.Must(template.New("ArchiveName").Parse(archiveNamePresets[ArchiveNameZeekctl]))
+
+// archiveNameData holds the values an archive naming template may use
+type archiveNameData struct {
+	// Path is the Zeek log path, such as conn
+	Path string
+	// Agent is the name of the partition the archive belongs to,
+	// or "espy" if the logs are not partitioned
+	Agent string
+	// Start and End are the bounds of the period the archive covers
+	Start time.Time
+	End   time.Time
+	// Seq numbers the archives written early for a period, starting
+	// from one. It is zero for an archive covering a whole period.
+	Seq int
+}
+
+// archiveNamer names archives using the ArchiveName template of a Zeek output
+type archiveNamer struct {
+	template  *template.Template
+	agent     string
+	extension string
+}
+
+// newArchiveNamer parses the ArchiveName of the Zeek config, which is either
+// the name of a preset or a template, and checks that it names archives
+// relative to the output directory after the time they cover. The
+// defaultArchiveAgent is used as the Agent if agent is empty.
+func newArchiveNamer(zeekCfg config.ZeekCfg, extension string, agent string) (archiveNamer, error) {
+	text, ok := archiveNamePresets[zeekCfg.ArchiveName]
+	if !ok {
+		text = zeekCfg.ArchiveName
+	}
+	tmpl, err := template.New("ArchiveName").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return archiveNamer{}, fmt.Errorf("invalid ArchiveName: %v", err)
+	}
+	if agent == "" {
+		agent = defaultArchiveAgent
+	}
+	n := archiveNamer{template: tmpl, agent: agent, extension: extension}
+
+	// try the template out on a couple of periods on different days
+	first := time.Date(2022, 02, 14, 16, 0, 0, 0, time.UTC)
+	second := first.AddDate(0, 0, 1).Add(time.Hour)
+	firstName, err := n.render("conn", first, first.Add(time.Hour), 0)
+	if err != nil {
+		return archiveNamer{}, fmt.Errorf("invalid ArchiveName: %v", err)
+	}
+	secondName, err := n.render("conn", second, second.Add(time.Hour), 0)
+	if err != nil {
+		return archiveNamer{}, fmt.Errorf("invalid ArchiveName: %v", err)
+	}
+	if firstName == "" || path.IsAbs(firstName) || strings.HasPrefix(firstName, "..") {
+		return archiveNamer{}, fmt.Errorf("ArchiveName must name archives inside the Zeek log directory, got %q", firstName)
+	}
+	if firstName == secondName {
+		return archiveNamer{}, fmt.Errorf("ArchiveName must include the time each archive covers, got %q", firstName)
+	}
+	// the janitor prunes the archives by dated directory
+	if (zeekCfg.RetentionDays != 0 || zeekCfg.RetentionSize != 0 || zeekCfg.MinFreePercent != 0) &&
+		strings.SplitN(firstName, "/", 2)[0] != first.Format("2006-01-02") {
+		return archiveNamer{}, fmt.Errorf("the retention settings require an ArchiveName which starts with a YYYY-MM-DD directory, got %q", firstName)
+	}
+	return n, nil
+}
+
+// name returns the path of an archive relative to the output directory,
+// including the compression extension. If the template does not use Seq,
+// the sequence number of an early archive is added before the extension.
+func (n archiveNamer) name(zeekPath string, start, end time.Time, seq int) string {
+	name, err := n.render(zeekPath, start, end, seq)
+	if err != nil {
+		log.WithError(err).Error("Could not apply the ArchiveName template, using the zeekctl layout instead")
+		fallback := n
+		fallback.template = zeekctlTemplate
+		return fallback.name(zeekPath, start, end, seq)
+	}
+	if seq > 0 {
+		if whole, _ := n.render(zeekPath, start, end, 0); whole == name {
+			name = fmt.Sprintf("%s.%d", name, seq)
+		}
+	}
+	return name + n.extension
+}
+
+// render applies the template, returning the cleaned path it produced
+func (n archiveNamer) render(zeekPath string, start, end time.Time, seq int) (string, error) {
+	var buf bytes.Buffer
+	err := n.template.Execute(&buf, archiveNameData{
+		Path:  zeekPath,
+		Agent: n.agent,
+		Start: start,
+		End:   end,
+		Seq:   seq,
+	})
+	if err != nil {
+		return "", err
+	}
+	name := strings.TrimSpace(buf.String())
+	if name == "" {
+		return "", nil
+	}
+	return path.Clean(name), nil
+}
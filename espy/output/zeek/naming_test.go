@@ -0,0 +1,86 @@
+package zeek
+
+import (
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArchiveNamePresets(t *testing.T) {
+	start := time.Date(2022, 02, 14, 16, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	for preset, expected := range map[string][]string{
+		ArchiveNameZeekctl:        {"2022-02-14/conn.16:00:00-17:00:00.log.gz", "2022-02-14/conn.16:00:00-17:00:00.2.log.gz"},
+		ArchiveNameZeekctlNoColon: {"2022-02-14/conn.16-00-00_17-00-00.log.gz", "2022-02-14/conn.16-00-00_17-00-00.2.log.gz"},
+	} {
+		zeekCfg := newTestZeekCfg(t)
+		zeekCfg.ArchiveName = preset
+		namer, err := newArchiveNamer(zeekCfg, ".log.gz", "")
+		require.Nil(t, err, preset)
+		require.Equal(t, expected[0], namer.name("conn", start, end, 0), preset)
+		require.Equal(t, expected[1], namer.name("conn", start, end, 2), preset)
+	}
+}
+
+func TestArchiveNameTemplate(t *testing.T) {
+	start := time.Date(2022, 02, 14, 16, 0, 0, 0, time.UTC)
+	end := start.Add(time.Hour)
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.ArchiveName = `{{.Agent}}/{{.Start.Format "20060102"}}/{{.Path}}_{{.Start.Format "1504"}}{{if .Seq}}_part{{.Seq}}{{end}}`
+	namer, err := newArchiveNamer(zeekCfg, ".log.zst", "collector1")
+	require.Nil(t, err)
+	require.Equal(t, "collector1/20220214/conn_1600.log.zst", namer.name("conn", start, end, 0))
+	require.Equal(t, "collector1/20220214/conn_1600_part3.log.zst", namer.name("conn", start, end, 3), "A template using Seq should not be numbered twice")
+
+	namer, err = newArchiveNamer(zeekCfg, ".log.zst", "")
+	require.Nil(t, err)
+	require.Equal(t, "espy/20220214/conn_1600.log.zst", namer.name("conn", start, end, 0), "Logs which are not partitioned should use a fixed Agent")
+
+	for _, invalid := range []string{
+		`{{.Start.Format "2006-01-02"`,
+		`/tmp/{{.Path}}.{{.Start.Unix}}`,
+		`../{{.Path}}.{{.Start.Unix}}`,
+		`{{.Path}}`,
+		`{{.Host}}/{{.Path}}.{{.Start.Unix}}`,
+	} {
+		zeekCfg.ArchiveName = invalid
+		_, err := newArchiveNamer(zeekCfg, ".log.gz", "")
+		require.NotNil(t, err, invalid)
+	}
+
+	zeekCfg.ArchiveName = `{{.Path}}/{{.Start.Format "2006-01-02-15"}}`
+	_, err = newArchiveNamer(zeekCfg, ".log.gz", "")
+	require.Nil(t, err)
+	zeekCfg.RetentionDays = 7
+	_, err = newArchiveNamer(zeekCfg, ".log.gz", "")
+	require.NotNil(t, err, "Retention should require dated directories")
+}
+
+func TestRollingArchiveName(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.ArchiveName = ArchiveNameZeekctlNoColon
+	zeekCfg.RotateLines = 10
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	require.Nil(t, w.(*RollingWriter).WriteECSRecords(testConnRecords(clock, 10)))
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	require.Nil(t, w.Close())
+
+	for _, archive := range []string{
+		"conn.16-00-00_17-00-00.1.log.gz",
+		"conn.16-00-00_17-00-00.2.log.gz",
+		"dns.16-00-00_17-00-00.log.gz",
+		"conn.17-00-00_17-00-00.log.gz",
+	} {
+		exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/"+archive)
+		require.Nil(t, err)
+		require.True(t, exists, archive+" should exist")
+	}
+}
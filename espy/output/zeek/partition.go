@@ -0,0 +1,176 @@
+package zeek
+
+import (
+	"context"
+	"fmt"
+	"path"
+
+	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/output"
+)
+
+// PartitionedWriter writes the events of each agent group to a Zeek log
+// tree of its own in a subdirectory of the output directory. Each tree has
+// its own spool files, rotation schedule, retention policies and hooks,
+// except for MinFreePercent. Since the partitions share a disk, a single
+// janitor deletes the oldest archives of any partition to free it up.
+type PartitionedWriter struct {
+	partitions []partition
+	// fallback is the index of the partition which receives
+	// the events matching none of the others
+	fallback int
+	// janitor keeps MinFreePercent of the disk free, if it is set
+	janitor *janitor
+}
+
+// partition is a Zeek writer for the events matching a set of criteria
+type partition struct {
+	name    string
+	matcher *output.Matcher
+	writer  output.Output
+}
+
+// NewPartitionedWriter constructs a writer for each of the partitions in
+// the Zeek config and one for the DefaultPartition if it is not among them
+func NewPartitionedWriter(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg, crashFunc func()) (output.Output, error) {
+	matchers, err := partitionMatchers(zeekCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &PartitionedWriter{fallback: -1}
+	for i := range zeekCfg.Partitions {
+		w.partitions = append(w.partitions, partition{name: zeekCfg.Partitions[i].Name, matcher: matchers[i]})
+		if zeekCfg.Partitions[i].Name == zeekCfg.DefaultPartition {
+			w.fallback = i
+		}
+	}
+	if w.fallback < 0 {
+		w.fallback = len(w.partitions)
+		w.partitions = append(w.partitions, partition{name: zeekCfg.DefaultPartition})
+	}
+
+	var dirs []string
+	for i := range w.partitions {
+		partitionCfg := zeekCfg
+		partitionCfg.OutputPath = path.Join(zeekCfg.OutputPath, w.partitions[i].name)
+		partitionCfg.Partitions = nil
+		partitionCfg.MinFreePercent = 0
+		dirs = append(dirs, partitionCfg.OutputPath)
+		if zeekCfg.RotateLogs {
+			w.partitions[i].writer, err = newRollingWriter(fs, clock, partitionCfg, w.partitions[i].name, crashFunc)
+		} else {
+			w.partitions[i].writer, err = newStandardWriter(fs, clock, partitionCfg, w.partitions[i].name)
+		}
+		if err != nil {
+			w.closeWriters()
+			return nil, fmt.Errorf("partition %q: %v", w.partitions[i].name, err)
+		}
+	}
+	if zeekCfg.RotateLogs && zeekCfg.MinFreePercent > 0 {
+		w.janitor = &janitor{
+			fs:        fs,
+			clock:     clock,
+			dirs:      dirs,
+			minFree:   zeekCfg.MinFreePercent,
+			freeSpace: diskFreePercent,
+		}
+		w.janitor.start()
+	}
+	log.WithField("dir", zeekCfg.OutputPath).Infof("Writing Zeek logs to %d partitions", len(w.partitions))
+	return w, nil
+}
+
+// partitionMatchers compiles the criteria of each partition. Partitions
+// group the events by agent, so IP ranges are only checked against host IPs.
+func partitionMatchers(zeekCfg config.ZeekCfg) ([]*output.Matcher, error) {
+	matchers := make([]*output.Matcher, len(zeekCfg.Partitions))
+	for i := range zeekCfg.Partitions {
+		var err error
+		matchers[i], err = output.NewHostMatcher(zeekCfg.Partitions[i].MatchCfg)
+		if err != nil {
+			return nil, fmt.Errorf("partition %q: %v", zeekCfg.Partitions[i].Name, err)
+		}
+	}
+	return matchers, nil
+}
+
+// WriteECSEvents hands each event to the first partition it matches,
+// or to the default partition if it matches none of them
+func (w *PartitionedWriter) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	grouped := make([][]input.ECSEvent, len(w.partitions))
+	for i := range events {
+		target := w.fallback
+		for j := range w.partitions {
+			if w.partitions[j].matcher != nil && w.partitions[j].matcher.Matches(&events[i]) {
+				target = j
+				break
+			}
+		}
+		grouped[target] = append(grouped[target], events[i])
+	}
+
+	// a partition which fails should not hold up the others
+	var firstErr error
+	for i := range w.partitions {
+		if len(grouped[i]) == 0 {
+			continue
+		}
+		if err := w.partitions[i].writer.WriteECSEvents(ctx, grouped[i]); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("partition %q: %v", w.partitions[i].name, err)
+		}
+	}
+	return firstErr
+}
+
+// Close closes the writer of every partition, returning the first error
+func (w *PartitionedWriter) Close() error {
+	if w.janitor != nil {
+		w.janitor.stop()
+	}
+	return w.closeWriters()
+}
+
+func (w *PartitionedWriter) closeWriters() error {
+	var firstErr error
+	for i := range w.partitions {
+		if w.partitions[i].writer == nil {
+			continue
+		}
+		if err := w.partitions[i].writer.Close(); err != nil {
+			log.WithError(err).WithField("partition", w.partitions[i].name).Error("Could not close a Zeek partition")
+			if firstErr == nil {
+				firstErr = fmt.Errorf("partition %q: %v", w.partitions[i].name, err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// Alive returns an error if the writer of any partition has stopped
+func (w *PartitionedWriter) Alive(ctx context.Context) error {
+	return w.check(ctx, output.HealthChecker.Alive)
+}
+
+// Ready returns an error if the writer of any partition is not ready
+func (w *PartitionedWriter) Ready(ctx context.Context) error {
+	return w.check(ctx, output.HealthChecker.Ready)
+}
+
+func (w *PartitionedWriter) check(ctx context.Context, check func(output.HealthChecker, context.Context) error) error {
+	for i := range w.partitions {
+		checker, ok := w.partitions[i].writer.(output.HealthChecker)
+		if !ok {
+			continue
+		}
+		if err := check(checker, ctx); err != nil {
+			return fmt.Errorf("partition %q: %v", w.partitions[i].name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+package zeek
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+)
+
+func testPartitionEvents(clock clock.Clock, key, hostname, hostIP string, count int) []input.ECSEvent {
+	events := make([]input.ECSEvent, count)
+	for i, record := range testConnRecords(clock, count) {
+		record.Agent.Hostname = hostname
+		record.Host.IP = []string{hostIP}
+		events[i] = input.ECSEvent{Key: key, Record: record}
+	}
+	return events
+}
+
+func TestPartitionedWriter(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.ArchiveName = `{{.Start.Format "2006-01-02"}}/{{.Agent}}-{{.Path}}.{{.Start.Format "15"}}`
+	zeekCfg.Partitions = []config.PartitionCfg{
+		{Name: "acme", MatchCfg: config.MatchCfg{AgentHostnames: []string{"acme-*"}}},
+		{Name: "globex", MatchCfg: config.MatchCfg{Keys: []string{"net-data:globex"}}},
+		{Name: "initech", MatchCfg: config.MatchCfg{IPRanges: []string{"192.168.50.0/24"}}},
+	}
+	w, err := NewPartitionedWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	events := testPartitionEvents(clock, "net-data:sysmon", "ACME-DC1", "10.0.0.1", 2)
+	events = append(events, testPartitionEvents(clock, "net-data:globex", "acme-ws1", "10.0.0.1", 1)...)
+	events = append(events, testPartitionEvents(clock, "net-data:globex", "ws1", "10.0.0.1", 3)...)
+	events = append(events, testPartitionEvents(clock, "net-data:sysmon", "ws2", "192.168.50.7", 4)...)
+	events = append(events, testPartitionEvents(clock, "net-data:sysmon", "ws3", "10.0.0.1", 5)...)
+	// a connection from another site into the initech range
+	crossSite := testPartitionEvents(clock, "net-data:sysmon", "ws4", "10.0.0.1", 1)
+	crossSite[0].Record.Destination.IP = "192.168.50.9"
+	events = append(events, crossSite...)
+	require.Nil(t, w.WriteECSEvents(context.Background(), events))
+	require.Nil(t, w.(*PartitionedWriter).Ready(context.Background()))
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	require.Nil(t, w.Close())
+
+	for partition, count := range map[string]int{"acme": 3, "globex": 3, "initech": 4, "default": 6} {
+		contents := readArchive(t, fs, "/opt/zeek/logs/"+partition+"/2022-02-14/"+partition+"-conn.16.log.gz")
+		require.Equal(t, count, strings.Count(contents, "\ttcp\t"), "Each event should go to the first partition its agent matches")
+	}
+}
+
+func TestPartitionedWriterDefault(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.Partitions = []config.PartitionCfg{
+		{Name: "hq", MatchCfg: config.MatchCfg{AgentHostnames: []string{"hq-*"}}},
+		{Name: "branch", MatchCfg: config.MatchCfg{AgentHostnames: []string{"br-*"}}},
+	}
+	zeekCfg.DefaultPartition = "hq"
+	w, err := NewPartitionedWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	require.Len(t, w.(*PartitionedWriter).partitions, 2, "A default partition which is listed should not get another writer")
+
+	require.Nil(t, w.WriteECSEvents(context.Background(), testPartitionEvents(clock, "net-data:sysmon", "laptop", "10.0.0.1", 2)))
+	require.Nil(t, w.Close())
+	contents := readArchive(t, fs, "/opt/zeek/logs/hq/2022-02-14/conn.16:00:00-16:17:18.log.gz")
+	require.Equal(t, 2, strings.Count(contents, "\ttcp\t"))
+
+	zeekCfg.Partitions[1].IPRanges = []string{"10.0.0.0/33"}
+	_, err = NewPartitionedWriter(fs, clock, zeekCfg, func() {})
+	require.NotNil(t, err, "Invalid criteria should be rejected")
+}
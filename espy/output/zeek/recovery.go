@@ -0,0 +1,203 @@
+package zeek
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// spoolTailSize is how much of the end of a leftover spool file
+// is read to find its last record
+const spoolTailSize = 64 * 1024
+
+// leftoverSpool describes a spool file left behind by a run of espy
+// which stopped without closing it
+type leftoverSpool struct {
+	openTime  time.Time
+	closeTime time.Time
+	// records is set if the spool holds at least one record
+	records bool
+	// closed is set if the spool already ends with a close footer
+	closed bool
+	// length is the size of the spool without any partially written last line
+	length int64
+	// dropped is the size of the partially written last line
+	dropped int64
+}
+
+// recoverSpoolFile finalizes a spool file of the given type which was left
+// behind by a previous run and queues it to be archived, so that the records
+// in it are archived under the times they were written rather than appended
+// to by this run. The spool file is removed if it holds no records.
+func (w *RollingWriter) recoverSpoolFile(zeekFileType TSVFileType, filePath string) error {
+	spool, ok, err := finishLeftoverSpool(w.fs, zeekFileType, filePath, w.clock.Now().Location())
+	if err != nil || !ok {
+		return err
+	}
+
+	archivePath := w.archivePathForFile(zeekFileType, spool.openTime, spool.closeTime)
+	pending, err := w.archiver.stage(filePath, archivePath)
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"file":    pending.dst,
+		"opened":  spool.openTime,
+		"closed":  spool.closeTime,
+		"dropped": spool.dropped,
+	}).Warn("Archiving a spool file left by a previous run")
+
+	w.archiver.queue(archiveJob{
+		files: []pendingArchive{pending},
+		rotation: Rotation{
+			Dir:   w.archiveDir,
+			Start: spool.openTime,
+			End:   spool.closeTime,
+		},
+	})
+	return nil
+}
+
+// finishLeftoverSpool closes a spool file left behind by a previous run
+// with a footer at the time of its last record, dropping any partly written
+// record. It returns false if there is no spool file or if it holds no
+// records, in which case it is removed.
+func finishLeftoverSpool(fs afero.Fs, zeekFileType TSVFileType, filePath string, location *time.Location) (leftoverSpool, bool, error) {
+	info, err := fs.Stat(filePath)
+	if os.IsNotExist(err) {
+		return leftoverSpool{}, false, nil
+	} else if err != nil {
+		return leftoverSpool{}, false, err
+	}
+
+	spool, err := readLeftoverSpool(fs, filePath, info, location)
+	if err != nil {
+		return spool, false, err
+	}
+	if !spool.records {
+		log.WithField("file", filePath).Debug("Removing empty spool file left by a previous run")
+		return spool, false, fs.Remove(filePath)
+	}
+	spool.dropped = info.Size() - spool.length
+	if spool.closed {
+		return spool, true, nil
+	}
+
+	file, err := fs.OpenFile(filePath, os.O_WRONLY, 0644)
+	if err != nil {
+		return spool, false, err
+	}
+	// drop any record which was only partly written when espy stopped
+	if spool.dropped != 0 {
+		err = file.Truncate(spool.length)
+	}
+	if err == nil {
+		_, err = file.Seek(spool.length, io.SeekStart)
+	}
+	if err == nil {
+		err = WriteTSVFooter(zeekFileType, spool.closeTime, file)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return spool, err == nil, err
+}
+
+// readLeftoverSpool finds when a leftover spool file was opened from its
+// header and when it was last written to from its last record
+func readLeftoverSpool(fs afero.Fs, filePath string, info os.FileInfo, location *time.Location) (leftoverSpool, error) {
+	spool := leftoverSpool{
+		openTime: info.ModTime().In(location),
+		length:   info.Size(),
+	}
+
+	file, err := fs.Open(filePath)
+	if err != nil {
+		return spool, err
+	}
+	defer file.Close()
+
+	// the open time is in the header at the start of the file
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "#") {
+			break
+		}
+		if value, ok := headerValue(line, "open"); ok {
+			if openTime, err := time.ParseInLocation("2006-01-02-15-04-05", value, location); err == nil {
+				spool.openTime = openTime
+			}
+		}
+	}
+	spool.closeTime = spool.openTime
+
+	// the last record and any footer are at the end of the file
+	offset := info.Size() - spoolTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		return spool, err
+	}
+	tail, err := io.ReadAll(file)
+	if err != nil {
+		return spool, err
+	}
+
+	// ignore a partially written last line
+	end := bytes.LastIndexByte(tail, '\n') + 1
+	spool.length = offset + int64(end)
+	lines := strings.Split(string(tail[:end]), "\n")
+	// the first line is incomplete if the tail starts in the middle of the file
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:]
+	}
+
+	for i := len(lines) - 1; i >= 0; i-- {
+		line := lines[i]
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			if _, ok := headerValue(line, "close"); ok {
+				spool.closed = true
+			}
+			continue
+		}
+		spool.records = true
+		ts := strings.SplitN(line, "\t", 2)[0]
+		if seconds, err := strconv.ParseFloat(ts, 64); err == nil {
+			closeTime := time.Unix(0, int64(seconds*1e9)).In(location)
+			// name the archive to the second, like the rotation times
+			closeTime = closeTime.Truncate(time.Second)
+			if closeTime.After(spool.openTime) {
+				spool.closeTime = closeTime
+			}
+		}
+		break
+	}
+	// the records may have scrolled out of the tail of a large spool
+	if !spool.records && offset > 0 {
+		spool.records = true
+		spool.closeTime = info.ModTime().In(location)
+	}
+	return spool, nil
+}
+
+// headerValue returns the value of a Zeek TSV header or footer line
+// with the given name
+func headerValue(line, name string) (string, bool) {
+	prefix := "#" + name + "\t"
+	if !strings.HasPrefix(line, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(line, prefix), true
+}
@@ -0,0 +1,82 @@
+package zeek
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+)
+
+func readArchive(t *testing.T, fs afero.Fs, archivePath string) string {
+	file, err := fs.Open(archivePath)
+	require.Nil(t, err, archivePath)
+	defer file.Close()
+	reader, err := gzip.NewReader(file)
+	require.Nil(t, err, archivePath)
+	contents, err := ioutil.ReadAll(reader)
+	require.Nil(t, err, archivePath)
+	return string(contents)
+}
+
+func TestRecoverSpoolFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	w, err := CreateRollingWritingSystem(fs, clock, "/opt/zeek/logs", func() {})
+	require.Nil(t, err)
+	writer := w.(*RollingWriter)
+
+	clock.Set(time.Date(2022, 02, 14, 16, 40, 0, 0, time.UTC))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 3)))
+	// simulate a crash partway through writing a record
+	_, err = writer.spoolFiles[ConnTSV{}].Write([]byte("1644857000.000000\t-\t10.0.0"))
+	require.Nil(t, err)
+	writer.timer.Stop()
+
+	// start up again after the next rotation should have happened
+	clock.Set(time.Date(2022, 02, 14, 18, 5, 0, 0, time.UTC))
+	w, err = CreateRollingWritingSystem(fs, clock, "/opt/zeek/logs", func() {})
+	require.Nil(t, err)
+	flushArchives(w)
+
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16:17:18-16:40:00.log.gz")
+	require.True(t, strings.HasPrefix(contents, "#separator"))
+	require.True(t, strings.HasSuffix(contents, "#close\t2022-02-14-16-40-00\n"), "The recovered log should be closed at its last record")
+	require.Equal(t, 3, strings.Count(contents, "\t10.0.0.1\t"), "The partly written record should be dropped")
+	require.NotContains(t, contents, "1644857000")
+
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/dns.16:17:18-16:17:18.log.gz")
+	require.Nil(t, err)
+	require.False(t, exists, "Spool files without records should not be archived")
+
+	// the new spool files belong to this run
+	require.Nil(t, w.Close())
+	contents = readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.18:00:00-18:05:00.log.gz")
+	require.Contains(t, contents, "#open\t2022-02-14-18-05-00\n")
+}
+
+func TestRecoverClosedSpoolFile(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	spool, err := OpenTSVFile(fs, clock, ConnTSV{}, "/opt/zeek/logs/ecs-spool/conn.log")
+	require.Nil(t, err)
+	require.Nil(t, WriteTSVLines(ConnTSV{}, testConnRecords(clock, 1), spool))
+	require.Nil(t, WriteTSVFooter(ConnTSV{}, clock.Now(), spool))
+	require.Nil(t, spool.Close())
+	// an archive from before the crash already has the same name
+	require.Nil(t, afero.WriteFile(fs, "/opt/zeek/logs/2022-02-14/conn.16:17:18-16:17:18.log.gz", nil, 0644))
+
+	w, err := CreateRollingWritingSystem(fs, clock, "/opt/zeek/logs", func() {})
+	require.Nil(t, err)
+	defer w.Close()
+	flushArchives(w)
+
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16:17:18-16:17:18.dup1.log.gz")
+	require.Equal(t, 1, strings.Count(contents, "#close"), "A footer should not be added twice")
+}
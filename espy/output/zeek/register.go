@@ -0,0 +1,54 @@
+package zeek
+
+import (
+	"github.com/spf13/afero"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/output"
+)
+
+func init() {
+	output.Register(config.ZeekOutputType, newZeekOutput)
+	output.RegisterChecker(config.ZeekOutputType, checkZeekOutput)
+}
+
+// newZeekOutput creates a Zeek writer for a zeek entry in the Outputs list
+func newZeekOutput(static config.OutputCfg, running config.OutputRunningCfg, env output.Environment) (output.Output, error) {
+	if len(static.Zeek.Partitions) > 0 {
+		return NewPartitionedWriter(env.Fs, env.Clock, static.Zeek, env.CrashFunc)
+	}
+	if static.Zeek.RotateLogs {
+		return NewRollingWriter(env.Fs, env.Clock, static.Zeek, env.CrashFunc)
+	}
+	return NewStandardWriter(env.Fs, env.Clock, static.Zeek)
+}
+
+// checkZeekOutput tests the rotation, time zone, compression, naming and
+// partition settings and that the Zeek log directory can be written to without opening
+// the spool files. A missing directory is not an error since it is created
+// when the output starts.
+func checkZeekOutput(static config.OutputCfg, running config.OutputRunningCfg, env output.Environment) error {
+	if static.Zeek.RotateLogs {
+		if _, err := rotationSchedule(static.Zeek); err != nil {
+			return err
+		}
+	}
+	if _, err := inTimezone(env.Clock, static.Zeek.Timezone); err != nil {
+		return err
+	}
+	compressor, err := newCompressor(static.Zeek)
+	if err != nil {
+		return err
+	}
+	if _, err := newArchiveNamer(static.Zeek, compressor.extension, ""); err != nil {
+		return err
+	}
+	if _, err := partitionMatchers(static.Zeek); err != nil {
+		return err
+	}
+	exists, err := afero.DirExists(env.Fs, static.Zeek.OutputPath)
+	if err != nil || !exists {
+		return err
+	}
+	return CheckWritable(env.Fs, static.Zeek.OutputPath)
+}
@@ -1,7 +1,8 @@
 package zeek
 
 import (
-	"compress/gzip"
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"path"
@@ -9,23 +10,24 @@ import (
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/creasty/defaults"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 
+	"github.com/activecm/espy/espy/config"
 	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
 	"github.com/activecm/espy/espy/output"
 	"github.com/robfig/cron"
 )
 
-// rotateOnMinute tells the rolling writer to rotate the
-// Zeek logs every minute rather than every hour. This may help
-// when debugging. Note that this *MUST* remain a const and not a var
-// so as not to create spaghetti code.
-const rotateOnMinute = false
-
 // RollingWriter is our continuous writer, expects
 // packet sessions in and will print to a spool file
-// until the end of the hour and will rotate them
+// until the end of the rotation interval and will rotate them.
+// A spool file which grows past the size or line limits is rotated
+// early into a sequence numbered archive for the interval.
+// Rotated spool files wait in a pending directory while they are
+// compressed in the background.
 type RollingWriter struct {
 	archiveDir string
 	spoolDir   string
@@ -33,74 +35,210 @@ type RollingWriter struct {
 	fs         afero.Fs
 	clock      clock.Clock
 	spoolFiles map[TSVFileType]afero.File
-
-	scheduler   *cron.Cron
+	spoolUsage map[TSVFileType]*spoolUsage
+	maxSize    int64
+	maxLines   int64
+	compressor compressor
+	namer      archiveNamer
+
+	schedule    cron.Schedule
+	timer       *clock.Timer
+	periodStart time.Time
+	// periodEnd is the time of the next scheduled rotation
+	periodEnd   time.Time
+	closed      bool
 	rotateMutex *sync.Mutex
 	crashFunc   func()
+	// rotateErr holds the error which stopped the scheduler, if any
+	rotateErr error
+	// writeErr holds the first error writing to the spool files, if any
+	writeErr error
+	// janitor deletes old archives, if retention policies are set
+	janitor *janitor
+	// hooks are run after each rotation, if any are configured
+	hooks *hookRunner
+	// archiver compresses the rotated spool files
+	archiver *archiver
+}
+
+// spoolUsage tracks how much has been written to a spool file
+type spoolUsage struct {
+	bytes int64
+	lines int64
+	// parts is the number of archives written early for the current period
+	parts int
+}
+
+// countingWriter records the bytes and lines written to a spool file
+type countingWriter struct {
+	writer io.Writer
+	usage  *spoolUsage
+}
+
+func (c countingWriter) Write(p []byte) (int, error) {
+	n, err := c.writer.Write(p)
+	c.usage.bytes += int64(n)
+	c.usage.lines += int64(bytes.Count(p[:n], []byte{'\n'}))
+	return n, err
 }
 
 // CreateRollingWritingSystem constructs new rolling writer system
-func CreateRollingWritingSystem(fs afero.Fs, clock clock.Clock, tgtDir string, crashFunc func()) (output.ECSWriter, error) {
+// which rotates the logs in tgtDir every hour
+func CreateRollingWritingSystem(fs afero.Fs, clock clock.Clock, tgtDir string, crashFunc func()) (output.Output, error) {
+	zeekCfg := config.ZeekCfg{}
+	if err := defaults.Set(&zeekCfg); err != nil {
+		return nil, err
+	}
+	zeekCfg.OutputPath = tgtDir
+	return NewRollingWriter(fs, clock, zeekCfg, crashFunc)
+}
+
+// NewRollingWriter constructs a rolling writer which rotates the logs
+// in the configured directory on the configured schedule
+func NewRollingWriter(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg, crashFunc func()) (output.Output, error) {
+	return newRollingWriter(fs, clock, zeekCfg, "", crashFunc)
+}
+
+// newRollingWriter constructs a rolling writer for the logs of the named
+// agent group, which is used as the Agent when naming archives. The
+// defaultArchiveAgent is used instead if agent is empty.
+func newRollingWriter(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg, agent string, crashFunc func()) (output.Output, error) {
+	clock, err := inTimezone(clock, zeekCfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	schedule, err := rotationSchedule(zeekCfg)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := newCompressor(zeekCfg)
+	if err != nil {
+		return nil, err
+	}
+	namer, err := newArchiveNamer(zeekCfg, compressor.extension, agent)
+	if err != nil {
+		return nil, err
+	}
+
 	w := &RollingWriter{
 		fs:         fs,
 		clock:      clock,
-		archiveDir: tgtDir,
-		spoolDir:   path.Join(tgtDir, "ecs-spool"),
+		archiveDir: zeekCfg.OutputPath,
+		spoolDir:   path.Join(zeekCfg.OutputPath, "ecs-spool"),
 		spoolFiles: make(map[TSVFileType]afero.File, len(RegisteredTSVFileTypes)),
+		spoolUsage: make(map[TSVFileType]*spoolUsage, len(RegisteredTSVFileTypes)),
+		maxSize:    int64(zeekCfg.RotateSize),
+		maxLines:   zeekCfg.RotateLines,
+		compressor: compressor,
+		namer:      namer,
+		schedule:   schedule,
+	}
+	w.rotateMutex = new(sync.Mutex)
+	w.crashFunc = crashFunc
+	w.hooks = newHookRunner(zeekCfg.Hooks, crashFunc)
+	w.archiver = newArchiver(fs, w.archiveDir, path.Join(w.spoolDir, "pending"), compressor, w.hooks)
+
+	// finish archiving the logs a previous run had already rotated
+	if err := w.archiver.recoverPending(clock.Now().Location()); err != nil {
+		w.stopWorkers()
+		return nil, err
 	}
 
 	for i := range RegisteredTSVFileTypes {
-		fileName := fmt.Sprintf("%s.log", RegisteredTSVFileTypes[i].Header().Path)
-		filePath := path.Join(w.spoolDir, fileName)
+		filePath := w.spoolPathForFile(RegisteredTSVFileTypes[i])
 
-		var err error
-		w.spoolFiles[RegisteredTSVFileTypes[i]], err = OpenTSVFile(fs, clock, RegisteredTSVFileTypes[i], filePath)
+		// archive anything left from a run which was not closed cleanly
+		// rather than appending to it
+		err := w.recoverSpoolFile(RegisteredTSVFileTypes[i], filePath)
+		if err == nil {
+			err = w.openSpoolFile(RegisteredTSVFileTypes[i], filePath)
+		}
 		if err != nil {
+			w.stopWorkers()
 			return nil, err
 		}
 	}
 
-	w.rotateMutex = new(sync.Mutex)
-	w.crashFunc = crashFunc
-	err := w.initWriterSchedule()
-	if err != nil {
-		return nil, err
+	// name the first logs after the interval they were opened in
+	now := clock.Now()
+	w.periodStart = previousRotation(schedule, now)
+	w.rotateMutex.Lock()
+	w.scheduleRotation(now)
+	w.rotateMutex.Unlock()
+	if zeekCfg.RotateSchedule != "" {
+		log.Infof("Rotating logs on the schedule %q at: %s", zeekCfg.RotateSchedule, w.spoolDir)
+	} else {
+		log.Infof("Rotating logs every %s at: %s", zeekCfg.RotateInterval, w.spoolDir)
 	}
 
+	w.janitor = newJanitor(fs, clock, zeekCfg)
+	if w.janitor != nil {
+		w.janitor.start()
+	}
+
+	// track the time since the last rotation from when the writer starts
+	metrics.ZeekRotated(w.archiveDir, now)
 	log.Info("Initialized rolling file writer")
 	return w, nil
 }
 
-func (w *RollingWriter) initWriterSchedule() (err error) {
-	w.scheduler = cron.New()
-	if rotateOnMinute {
-		// Run every minute on the 0th second
-		err = w.scheduler.AddFunc("0 * * * * *", w.rotateLogsWrapper)
-		log.Infof("Rotating logs every minute at: %s", w.spoolDir)
-	} else {
-		// Run every hour
-		err = w.scheduler.AddFunc("0 0 * * * *", w.rotateLogsWrapper)
-		log.Infof("Rotating logs every hour at: %s", w.spoolDir)
+// scheduleRotation sets a timer for the first rotation after the given
+// time. The caller must hold the rotateMutex.
+func (w *RollingWriter) scheduleRotation(after time.Time) {
+	next := w.schedule.Next(after)
+	if next.IsZero() {
+		log.WithField("dir", w.archiveDir).Warn("The rotation schedule has no future rotations")
+		return
 	}
-	if err != nil {
-		return err
-	}
-	w.scheduler.Start()
+	w.periodEnd = next
+	w.timer = w.clock.AfterFunc(next.Sub(w.clock.Now()), func() {
+		w.rotateOnSchedule(next)
+	})
+}
 
-	return nil
+// WriteECSEvents writes the parsed records of the given events out to Zeek files.
+// The context is not used since the files are written without blocking.
+func (w *RollingWriter) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	return w.WriteECSRecords(RecordsFromEvents(events))
 }
 
-// WriteECSRecords writes Elastic Common Schema records out to Zeek files
+// WriteECSRecords writes Elastic Common Schema records out to Zeek files.
+// Once a write fails, the writer is no longer reported as alive since
+// records may have been lost.
 func (w *RollingWriter) WriteECSRecords(outputData []input.ECSRecord) error {
 	w.rotateMutex.Lock()
 	defer w.rotateMutex.Unlock()
 	log.Debugf("Writing %d records", len(outputData))
 
+	if err := w.writeRecords(outputData); err != nil {
+		if w.writeErr == nil {
+			w.writeErr = err
+		}
+		return err
+	}
+	return nil
+}
+
+// writeRecords writes the records to their spool files, rotating any
+// which reach the size or line limit. The caller must hold the rotateMutex.
+func (w *RollingWriter) writeRecords(outputData []input.ECSRecord) error {
 	for zeekFileType, groupedData := range MapECSRecordsToTSVFiles(outputData) {
-		err := WriteTSVLines(zeekFileType, groupedData, w.spoolFiles[zeekFileType])
+		if _, ok := w.spoolFiles[zeekFileType]; !ok {
+			// the spool file could not be reopened after it was last rotated
+			if err := w.openSpoolFile(zeekFileType, w.spoolPathForFile(zeekFileType)); err != nil {
+				return err
+			}
+		}
+		usage := w.spoolUsage[zeekFileType]
+		err := WriteTSVLines(zeekFileType, groupedData, countingWriter{w.spoolFiles[zeekFileType], usage})
 		if err != nil {
 			return err
 		}
+		if (w.maxSize > 0 && usage.bytes >= w.maxSize) || (w.maxLines > 0 && usage.lines >= w.maxLines) {
+			if err := w.rotateEarly(zeekFileType); err != nil {
+				return err
+			}
+		}
 	}
 
 	return nil
@@ -109,108 +247,244 @@ func (w *RollingWriter) WriteECSRecords(outputData []input.ECSRecord) error {
 // Close will close out the file progress and save everything
 // from spool to main log output
 func (w *RollingWriter) Close() error {
-	return w.rotateLogs(true)
+	w.rotateMutex.Lock()
+	defer w.rotateMutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	if w.janitor != nil {
+		w.janitor.stop()
+	}
+	w.closed = true
+	err := w.rotateLogs(w.clock.Now(), true)
+	// finish compressing the final logs and give the hooks
+	// a chance to process them
+	w.stopWorkers()
+	return err
+}
+
+// stopWorkers waits for the archiver and then the hooks to finish
+func (w *RollingWriter) stopWorkers() {
+	w.archiver.close()
+	if w.hooks != nil {
+		w.hooks.close()
+	}
 }
 
-func (w *RollingWriter) rotateLogsWrapper() {
-	err := w.rotateLogs(false)
+// Alive returns an error if the log rotation scheduler has stopped
+// or if writing to the spool files has failed
+func (w *RollingWriter) Alive(ctx context.Context) error {
+	w.rotateMutex.Lock()
+	defer w.rotateMutex.Unlock()
+	if w.rotateErr != nil {
+		return fmt.Errorf("log rotation stopped: %v", w.rotateErr)
+	}
+	if w.writeErr != nil {
+		return fmt.Errorf("writing logs failed: %v", w.writeErr)
+	}
+	return nil
+}
+
+// Ready returns an error if the spool files cannot be written to
+// or if any rotated logs could not be archived
+func (w *RollingWriter) Ready(ctx context.Context) error {
+	if err := CheckWritable(w.fs, w.spoolDir); err != nil {
+		return err
+	}
+	return w.archiver.err()
+}
+
+// rotateOnSchedule rotates the logs for the interval ending at the given
+// time and schedules the next rotation
+func (w *RollingWriter) rotateOnSchedule(periodEnd time.Time) {
+	w.rotateMutex.Lock()
+	defer w.rotateMutex.Unlock()
+	if w.closed {
+		return
+	}
+
+	err := w.rotateLogs(periodEnd, false)
 	if err != nil {
 		log.WithError(err).
 			WithField("fatal", true).
 			Error("Could not perform scheduled log rotation")
+		w.rotateErr = err
 		// let the rest of the system know we had a fatal error
-		// in the cron scheduling thread
-		w.scheduler.Stop()
+		// in the rotation timer
 		w.crashFunc()
+		return
 	}
+	w.scheduleRotation(periodEnd)
 }
 
-func (w *RollingWriter) rotateLogs(close bool) error {
-	w.rotateMutex.Lock()
-	defer w.rotateMutex.Unlock()
-
+// rotateLogs queues the spool files to be archived as the logs for the
+// period ending at periodEnd. Unless the writer is closing, new spool files
+// are opened for the next period. The caller must hold the rotateMutex.
+func (w *RollingWriter) rotateLogs(periodEnd time.Time, close bool) error {
 	if !close {
 		log.Debug("About to rotate logs")
 	} else {
 		log.Debug("Closing files")
 	}
 
-	for zeekFileType, spoolFile := range w.spoolFiles {
-		currTime := w.clock.Now()
-
-		// Write the closing footer to our spool file
-		err := WriteTSVFooter(zeekFileType, currTime, spoolFile)
-		if err != nil {
-			return err
+	job := archiveJob{rotation: Rotation{Dir: w.archiveDir, Start: w.periodStart, End: periodEnd}}
+	for zeekFileType := range w.spoolFiles {
+		archivePath := w.archivePathForFile(zeekFileType, w.periodStart, periodEnd)
+		// once part of the period has been archived early, the rest of
+		// it is archived as the next part
+		if w.spoolUsage[zeekFileType].parts > 0 || w.archiveExists(w.partPathForFile(zeekFileType, 1)) {
+			archivePath = w.nextPartPath(zeekFileType)
 		}
-
-		// close the file out, prepare for reading
-		if err := spoolFile.Close(); err != nil {
-			return err
+		pending, err := w.closeSpoolFile(zeekFileType, periodEnd, archivePath, !close)
+		if pending.src != "" {
+			job.files = append(job.files, pending)
 		}
-
-		// archive the spool file we just closed out
-		srcFile, err := w.fs.Open(spoolFile.Name())
 		if err != nil {
+			// still archive the files which were closed
+			w.archiver.queue(job)
 			return err
 		}
+		w.spoolUsage[zeekFileType].parts = 0
+	}
+	if !close {
+		log.Debugf("Rolled over logs, created new spool directory in %s", w.spoolDir)
+	}
+	w.archiver.queue(job)
+	w.periodStart = periodEnd
+	metrics.ZeekRotated(w.archiveDir, w.clock.Now())
+	return nil
+}
 
-		dirDate := currTime.Format("2006-01-02")
-		datedArchiveDir := path.Join(w.archiveDir, dirDate)
-		if err := w.fs.MkdirAll(datedArchiveDir, 0755); err != nil {
-			return err
-		}
+// rotateEarly queues the spool file of the given type to be archived as the next part
+// of the current period after it has reached the size or line limit.
+// The caller must hold the rotateMutex.
+func (w *RollingWriter) rotateEarly(zeekFileType TSVFileType) error {
+	usage := *w.spoolUsage[zeekFileType]
+	archivePath := w.nextPartPath(zeekFileType)
+	now := w.clock.Now()
+	pending, err := w.closeSpoolFile(zeekFileType, now, archivePath, true)
+	if pending.src != "" {
+		w.archiver.queue(archiveJob{
+			files: []pendingArchive{pending},
+			rotation: Rotation{
+				Dir:   w.archiveDir,
+				Start: w.periodStart,
+				End:   now,
+				Early: true,
+			},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	log.WithFields(log.Fields{
+		"bytes": usage.bytes,
+		"lines": usage.lines,
+	}).Infof("Rotated %s early after reaching its size or line limit", zeekFileType.Header().Path)
+	return nil
+}
 
-		archivePath := w.archivePathForFile(zeekFileType, currTime)
+// closeSpoolFile closes the spool file of the given type with a footer
+// for the given close time and moves it aside to wait to be archived to
+// archivePath. If reopen is set, a new spool file is opened in its place.
+// The pending file is returned even if the new spool file cannot be opened,
+// in which case the spool file is forgotten so that it is opened again
+// before it is next written to.
+func (w *RollingWriter) closeSpoolFile(zeekFileType TSVFileType, closeTime time.Time, archivePath string, reopen bool) (pendingArchive, error) {
+	spoolFile := w.spoolFiles[zeekFileType]
+	spoolPath := spoolFile.Name()
+
+	// Write the closing footer to our spool file
+	err := WriteTSVFooter(zeekFileType, closeTime, spoolFile)
+	if err != nil {
+		return pendingArchive{}, err
+	}
 
-		// Open the gzip file and make sure it doesn't exist
-		gzfile, err := w.fs.Create(archivePath)
-		if err != nil {
-			return err
+	// close the file out, prepare for reading
+	if err := spoolFile.Close(); err != nil {
+		return pendingArchive{}, err
+	}
+
+	pending, err := w.archiver.stage(spoolPath, archivePath)
+	if err != nil {
+		return pendingArchive{}, err
+	}
+
+	// Spool gets moved, we must remake it if we're not closing
+	if reopen {
+		log.Debug("About to re-create spool file")
+		if err := w.openSpoolFile(zeekFileType, spoolPath); err != nil {
+			delete(w.spoolFiles, zeekFileType)
+			return pending, err
 		}
-		gzout := gzip.NewWriter(gzfile)
+	}
+	return pending, nil
+}
 
-		// copy contents from source file to gzip file
-		size, err := io.Copy(gzout, srcFile)
+// openSpoolFile opens the spool file of the given type and records the
+// size of its header
+func (w *RollingWriter) openSpoolFile(zeekFileType TSVFileType, filePath string) error {
+	file, err := OpenTSVFile(w.fs, w.clock, zeekFileType, filePath)
+	if err != nil {
+		return err
+	}
+	usage := &spoolUsage{}
+	if w.spoolUsage[zeekFileType] != nil {
+		usage.parts = w.spoolUsage[zeekFileType].parts
+	}
 
-		srcFile.Close()
-		gzout.Close()
-		gzfile.Close()
+	info, err := w.fs.Stat(filePath)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	usage.bytes = info.Size()
 
-		if err != nil {
-			return err
-		}
+	w.spoolFiles[zeekFileType] = file
+	w.spoolUsage[zeekFileType] = usage
+	return nil
+}
 
-		if err = w.fs.Remove(srcFile.Name()); err != nil {
-			return err
-		}
+// spoolPathForFile returns the path of the spool file for the logs of the given type
+func (w *RollingWriter) spoolPathForFile(zeekFileType TSVFileType) string {
+	return path.Join(w.spoolDir, fmt.Sprintf("%s.log", zeekFileType.Header().Path))
+}
 
-		log.Infof("Log written: %s    size: %d", archivePath, size)
+// archivePathForFile returns the path of the archive for the logs of the
+// given type covering the period from start to end
+func (w *RollingWriter) archivePathForFile(zeekFileType TSVFileType, start, end time.Time) string {
+	return path.Join(w.archiveDir, w.namer.name(zeekFileType.Header().Path, start, end, 0))
+}
 
-		// Spool gets deleted, we must remake it if we're not closing
-		if !close {
-			log.Debug("About to re-create spool file")
-			w.spoolFiles[zeekFileType], err = OpenTSVFile(w.fs, w.clock, zeekFileType, spoolFile.Name())
-			if err != nil {
-				return err
-			}
+// partPathForFile returns the path of the given part of the archives for
+// the logs of the given type covering the current period. Parts are
+// numbered from one.
+func (w *RollingWriter) partPathForFile(zeekFileType TSVFileType, part int) string {
+	end := w.periodEnd
+	if end.IsZero() {
+		// the schedule has ended, so there is no period to name the parts after
+		end = w.periodStart
+	}
+	return path.Join(w.archiveDir, w.namer.name(zeekFileType.Header().Path, w.periodStart, end, part))
+}
 
-			log.Debugf("Rolled over logs, created new spool directory in %s", w.spoolDir)
-		}
+// nextPartPath returns the path of the next part of the archives for the
+// logs of the given type covering the current period, skipping any parts
+// written before espy was restarted
+func (w *RollingWriter) nextPartPath(zeekFileType TSVFileType) string {
+	usage := w.spoolUsage[zeekFileType]
+	usage.parts++
+	for w.archiveExists(w.partPathForFile(zeekFileType, usage.parts)) {
+		usage.parts++
 	}
-	return nil
+	return w.partPathForFile(zeekFileType, usage.parts)
 }
 
-func (w *RollingWriter) archivePathForFile(zeekFileType TSVFileType, fileTime time.Time) string {
-	path := zeekFileType.Header().Path
-	if rotateOnMinute {
-		startTime := fileTime.Add(-1 * time.Minute)
-		return w.archiveDir + startTime.Format("/2006-01-02") + "/" +
-			path + "." + startTime.Format("15:04:00") + "-" +
-			fileTime.Format("15:04:05") + ".log.gz"
-	} // else rotate on the hour
-	startTime := fileTime.Add(-1 * time.Hour)
-	return w.archiveDir + startTime.Format("/2006-01-02") + "/" +
-		path + "." + startTime.Format("15:00:00") + "-" +
-		fileTime.Format("15:00:00") + ".log.gz"
+// archiveExists returns true if the given archive has already been
+// written or is waiting to be written
+func (w *RollingWriter) archiveExists(archivePath string) bool {
+	return w.archiver.exists(archivePath)
 }
@@ -1,13 +1,20 @@
 package zeek
 
 import (
+	"context"
+	"errors"
 	"path"
 	"testing"
 	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/creasty/defaults"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/output"
 )
 
 func TestOpenRollingFiles(t *testing.T) {
@@ -43,3 +50,271 @@ func TestCloseRollingFiles(t *testing.T) {
 		require.True(t, testVal, "Archive file for "+zeekPath+" log should exist")
 	}
 }
+
+func TestRollingHealth(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	w, err := CreateRollingWritingSystem(fs, clock, "/opt/zeek/logs", func() {})
+	require.Nil(t, err, "Should be able to open spool files")
+	writer := w.(*RollingWriter)
+	defer writer.Close()
+
+	require.Nil(t, writer.Alive(context.Background()))
+	require.Nil(t, writer.Ready(context.Background()))
+
+	writer.fs = afero.NewReadOnlyFs(fs)
+	require.NotNil(t, writer.Ready(context.Background()), "A read only spool directory should not be ready")
+
+	writer.rotateErr = errors.New("disk full")
+	require.NotNil(t, writer.Alive(context.Background()), "A failed rotation should be reported")
+}
+
+func newTestZeekCfg(t *testing.T) config.ZeekCfg {
+	zeekCfg := config.ZeekCfg{}
+	require.Nil(t, defaults.Set(&zeekCfg))
+	zeekCfg.OutputPath = "/opt/zeek/logs"
+	return zeekCfg
+}
+
+// flushArchives waits for the logs rotated so far to be archived
+func flushArchives(w output.Output) {
+	w.(*RollingWriter).archiver.flush()
+}
+
+func requireArchives(t *testing.T, fs afero.Fs, archives ...string) {
+	for _, zeekFileType := range RegisteredTSVFileTypes {
+		zeekPath := zeekFileType.Header().Path
+		for _, archive := range archives {
+			archivePath := path.Join("/opt/zeek/logs", path.Dir(archive), zeekPath+"."+path.Base(archive)+".log.gz")
+			testVal, testErr := afero.Exists(fs, archivePath)
+			require.Nil(t, testErr)
+			require.True(t, testVal, "Archive file "+archivePath+" should exist")
+		}
+	}
+}
+
+func TestRollingInterval(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateInterval = 15 * time.Minute
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	clock.Set(time.Date(2022, 02, 14, 16, 50, 0, 0, time.UTC))
+	flushArchives(w)
+	requireArchives(t, fs, "2022-02-14/16:15:00-16:30:00", "2022-02-14/16:30:00-16:45:00")
+
+	require.Nil(t, w.Close())
+	requireArchives(t, fs, "2022-02-14/16:45:00-16:50:00")
+
+	// no more rotations should happen once closed
+	clock.Add(time.Hour)
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16:50:00-17:00:00.log.gz")
+	require.Nil(t, err)
+	require.False(t, exists, "A closed writer should not rotate its logs")
+}
+
+func TestRollingDaily(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateInterval = 24 * time.Hour
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	defer w.Close()
+
+	clock.Set(time.Date(2022, 02, 16, 1, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	requireArchives(t, fs, "2022-02-14/00:00:00-00:00:00", "2022-02-15/00:00:00-00:00:00")
+}
+
+func TestRollingSchedule(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateSchedule = "*/20 * * * *"
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	defer w.Close()
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	requireArchives(t, fs,
+		"2022-02-14/16:00:00-16:20:00",
+		"2022-02-14/16:20:00-16:40:00",
+		"2022-02-14/16:40:00-17:00:00",
+	)
+}
+
+func TestRollingTimezone(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 3, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.Timezone = "America/Denver"
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	clock.Set(time.Date(2022, 02, 14, 4, 0, 0, 0, time.UTC))
+	require.Nil(t, w.Close())
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-13/conn.20:00:00-21:00:00.log.gz")
+	require.Contains(t, contents, "#open\t2022-02-13-20-17-18\n")
+	require.Contains(t, contents, "#close\t2022-02-13-21-00-00\n")
+
+	zeekCfg.Timezone = "Mars/Olympus_Mons"
+	_, err = NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.NotNil(t, err, "An unknown time zone should be rejected")
+}
+
+func TestRollingInvalidSchedule(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateSchedule = "every tuesday"
+	_, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.NotNil(t, err, "An invalid cron expression should be rejected")
+
+	zeekCfg = newTestZeekCfg(t)
+	zeekCfg.RotateInterval = 0
+	_, err = NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.NotNil(t, err, "A zero rotation interval should be rejected")
+}
+
+func testConnRecords(clock clock.Clock, count int) []input.ECSRecord {
+	records := make([]input.ECSRecord, count)
+	for i := range records {
+		records[i].Timestamp = clock.Now()
+		records[i].Event.Provider = "Microsoft-Windows-Sysmon"
+		records[i].Event.Code = "3"
+		records[i].Source.IP = "10.0.0.1"
+		records[i].Source.Port = "50000"
+		records[i].Destination.IP = "10.0.0.2"
+		records[i].Destination.Port = "443"
+		records[i].Network.Transport = "tcp"
+	}
+	return records
+}
+
+func TestRollingLineLimit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLines = 10
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	writer := w.(*RollingWriter)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 6)))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 6)))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 15)))
+	require.Equal(t, int64(0), writer.spoolUsage[ConnTSV{}].lines, "The conn spool should be empty after rotating")
+	flushArchives(w)
+
+	for _, part := range []string{"1", "2"} {
+		exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00."+part+".log.gz")
+		require.Nil(t, err)
+		require.True(t, exists, "Part "+part+" of the conn log should be archived early")
+	}
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/dns.16:00:00-17:00:00.1.log.gz")
+	require.Nil(t, err)
+	require.False(t, exists, "Logs under the limit should not be rotated early")
+
+	clock.Set(time.Date(2022, 02, 14, 17, 0, 0, 0, time.UTC))
+	flushArchives(w)
+	for _, archive := range []string{"conn.16:00:00-17:00:00.3.log.gz", "dns.16:00:00-17:00:00.log.gz"} {
+		exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/"+archive)
+		require.Nil(t, err)
+		require.True(t, exists, archive+" should be written by the scheduled rotation")
+	}
+
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 10)))
+	require.Nil(t, w.Close())
+	exists, err = afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.17:00:00-18:00:00.1.log.gz")
+	require.Nil(t, err)
+	require.True(t, exists, "Sequence numbers should start over in the next period")
+}
+
+func TestRollingSizeLimit(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateSize = 4096
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+
+	writer := w.(*RollingWriter)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 1)))
+	require.Less(t, writer.spoolUsage[ConnTSV{}].bytes, int64(4096))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 100)))
+	require.Nil(t, w.Close())
+
+	for _, part := range []string{"1", "2"} {
+		exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00."+part+".log.gz")
+		require.Nil(t, err)
+		require.True(t, exists, "Part "+part+" of the conn log should be archived")
+	}
+}
+
+func TestRollingLimitsAfterRestart(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLines = 10
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	writer := w.(*RollingWriter)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 10)))
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 4)))
+
+	// simulate a crash by abandoning the writer with its spool files open
+	writer.timer.Stop()
+	flushArchives(w)
+	w, err = NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	writer = w.(*RollingWriter)
+	require.Equal(t, int64(0), writer.spoolUsage[ConnTSV{}].lines, "Entries left in the spool should be archived")
+
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 10)))
+	flushArchives(w)
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00.2.log.gz")
+	require.Nil(t, err)
+	require.True(t, exists, "Parts written before the restart should not be overwritten")
+	require.Nil(t, w.Close())
+}
+
+func TestRollingWriteFailure(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLines = 10
+	w, err := NewRollingWriter(fs, clock, zeekCfg, func() {})
+	require.Nil(t, err)
+	writer := w.(*RollingWriter)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 6)))
+
+	// the spool file is moved aside but cannot be reopened
+	writer.fs = afero.NewReadOnlyFs(fs)
+	require.NotNil(t, writer.WriteECSRecords(testConnRecords(clock, 6)))
+	require.NotNil(t, writer.Alive(context.Background()), "A failed write should be reported")
+	require.NotContains(t, writer.spoolFiles, ConnTSV{}, "A closed spool file should not be written to")
+
+	writer.fs = fs
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 2)), "The spool file should be reopened")
+	require.NotNil(t, writer.Alive(context.Background()), "Records lost by the failed write should still be reported")
+	require.Nil(t, w.Close())
+	for _, part := range []string{"1", "2"} {
+		exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16:00:00-17:00:00."+part+".log.gz")
+		require.Nil(t, err)
+		require.True(t, exists, "Part "+part+" of the conn log should be archived")
+	}
+}
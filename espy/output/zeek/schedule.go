@@ -0,0 +1,86 @@
+package zeek
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron"
+
+	"github.com/activecm/espy/espy/config"
+)
+
+// rotationSchedule returns the schedule on which the rolling writer
+// rotates its logs. RotateSchedule, if set, takes precedence over
+// RotateInterval.
+func rotationSchedule(cfg config.ZeekCfg) (cron.Schedule, error) {
+	if cfg.RotateSchedule != "" {
+		schedule, err := cron.ParseStandard(cfg.RotateSchedule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid Zeek RotateSchedule %q: %v", cfg.RotateSchedule, err)
+		}
+		return schedule, nil
+	}
+	if cfg.RotateInterval < time.Second {
+		return nil, fmt.Errorf("the Zeek RotateInterval must be at least one second, got %s", cfg.RotateInterval)
+	}
+	if cfg.RotateInterval > day && cfg.RotateInterval%day != 0 {
+		return nil, fmt.Errorf("a Zeek RotateInterval longer than a day must be a whole number of days, got %s", cfg.RotateInterval)
+	}
+	return intervalSchedule{interval: cfg.RotateInterval}, nil
+}
+
+const day = 24 * time.Hour
+
+// intervalSchedule rotates the logs at a fixed interval of wall clock time
+// aligned to midnight. For example, a 15 minute interval rotates the logs on
+// the hour and at a quarter past, half past and a quarter to. If the interval
+// does not divide a day evenly, the last interval of each day is shortened.
+// Intervals longer than a day rotate at midnight every so many days. On the
+// days daylight saving time starts or ends, the rotations stay on the same
+// wall clock times, so the interval around the change is shorter or longer.
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+// Next returns the first rotation time after t
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	if s.interval > day {
+		// count whole days from the Unix epoch by the calendar date
+		days := int(s.interval / day)
+		date := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+		elapsed := int(date.Unix() / int64(day/time.Second))
+		return time.Date(1970, 1, 1+(elapsed/days+1)*days, 0, 0, 0, 0, t.Location())
+	}
+
+	tomorrow := time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+	sinceMidnight := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute +
+		time.Duration(t.Second())*time.Second + time.Duration(t.Nanosecond())
+	for boundary := (sinceMidnight/s.interval + 1) * s.interval; boundary < day; boundary += s.interval {
+		// time.Date interprets the boundary as a wall clock time, moving
+		// it forward if it falls in the hour skipped when DST starts
+		next := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, int(boundary), t.Location())
+		// a boundary in the hour repeated when DST ends may be the
+		// first occurrence, which has already passed
+		if next.After(t) {
+			return next
+		}
+	}
+	return tomorrow
+}
+
+// previousRotation returns the latest rotation time on the schedule
+// which is not after t. If none can be found within a year, t is returned.
+func previousRotation(schedule cron.Schedule, t time.Time) time.Time {
+	lookbacks := []time.Duration{time.Hour, 24 * time.Hour, 31 * 24 * time.Hour, 366 * 24 * time.Hour}
+	for _, lookback := range lookbacks {
+		prev := schedule.Next(t.Add(-lookback))
+		if prev.IsZero() || prev.After(t) {
+			continue
+		}
+		for next := schedule.Next(prev); !next.IsZero() && !next.After(t); next = schedule.Next(next) {
+			prev = next
+		}
+		return prev
+	}
+	return t
+}
@@ -0,0 +1,79 @@
+package zeek
+
+import (
+	"testing"
+	"time"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIntervalSchedule(t *testing.T) {
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2022, 02, day, hour, min, 0, 0, time.UTC)
+	}
+
+	quarterHour := intervalSchedule{interval: 15 * time.Minute}
+	require.Equal(t, at(14, 16, 30), quarterHour.Next(at(14, 16, 17)))
+	require.Equal(t, at(14, 16, 45), quarterHour.Next(at(14, 16, 30)), "A rotation time should not be returned twice")
+	require.Equal(t, at(15, 0, 0), quarterHour.Next(at(14, 23, 50)))
+
+	// 7 hours does not divide a day, so the last interval is cut short at midnight
+	sevenHours := intervalSchedule{interval: 7 * time.Hour}
+	require.Equal(t, at(14, 21, 0), sevenHours.Next(at(14, 16, 17)))
+	require.Equal(t, at(15, 0, 0), sevenHours.Next(at(14, 21, 0)))
+
+	require.Equal(t, at(14, 16, 15), previousRotation(quarterHour, at(14, 16, 17)))
+	require.Equal(t, at(14, 16, 15), previousRotation(quarterHour, at(14, 16, 15)))
+	require.Equal(t, at(14, 14, 0), previousRotation(sevenHours, at(14, 16, 17)))
+}
+
+func TestIntervalScheduleDST(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+	at := func(month, day, hour, min int) time.Time {
+		return time.Date(2022, time.Month(month), day, hour, min, 0, 0, newYork)
+	}
+	hourly := intervalSchedule{interval: time.Hour}
+
+	// DST starts at 2:00 EST on March 13th, so the clocks skip to 3:00 EDT
+	require.Equal(t, at(3, 13, 3, 0), hourly.Next(at(3, 13, 1, 0)))
+	require.Equal(t, at(3, 13, 4, 0), hourly.Next(at(3, 13, 3, 0)))
+	require.Equal(t, at(3, 14, 1, 0), hourly.Next(at(3, 14, 0, 30)))
+
+	// DST ends at 2:00 EDT on November 6th, so the clocks go back to 1:00 EST
+	firstOne := at(11, 6, 1, 30)
+	secondOne := firstOne.Add(time.Hour)
+	require.Equal(t, firstOne.Hour(), secondOne.Hour())
+	require.Equal(t, at(11, 6, 2, 0), hourly.Next(firstOne))
+	require.Equal(t, at(11, 6, 2, 0), hourly.Next(secondOne))
+	require.Equal(t, at(11, 6, 3, 0), hourly.Next(at(11, 6, 2, 0)))
+	require.Equal(t, at(11, 7, 1, 0), hourly.Next(at(11, 7, 0, 30)))
+
+	daily := intervalSchedule{interval: 24 * time.Hour}
+	require.Equal(t, at(3, 14, 0, 0), daily.Next(at(3, 13, 12, 0)))
+	require.Equal(t, at(11, 7, 0, 0), daily.Next(at(11, 6, 12, 0)))
+
+	// rotations walk through the changes on wall clock hours
+	for _, start := range []time.Time{at(3, 12, 0, 0), at(11, 5, 0, 0)} {
+		for next := hourly.Next(start); next.Before(start.AddDate(0, 0, 3)); next = hourly.Next(next) {
+			require.Zero(t, next.Minute(), next)
+			require.Equal(t, next, previousRotation(hourly, next.Add(time.Minute)))
+		}
+	}
+}
+
+func TestIntervalScheduleDays(t *testing.T) {
+	newYork, err := time.LoadLocation("America/New_York")
+	require.NoError(t, err)
+
+	twoDays := intervalSchedule{interval: 48 * time.Hour}
+	next := twoDays.Next(time.Date(2022, 11, 5, 12, 0, 0, 0, newYork))
+	require.Equal(t, time.Date(2022, 11, 6, 0, 0, 0, 0, newYork), next)
+	require.Equal(t, time.Date(2022, 11, 8, 0, 0, 0, 0, newYork), twoDays.Next(next))
+
+	_, err = rotationSchedule(config.ZeekCfg{RotateInterval: 36 * time.Hour})
+	require.Error(t, err)
+	_, err = rotationSchedule(config.ZeekCfg{RotateInterval: 72 * time.Hour})
+	require.NoError(t, err)
+}
@@ -1,25 +1,30 @@
 package zeek
 
 import (
-	"compress/gzip"
+	"context"
 	"fmt"
-	"io"
 	"path"
+	"sync"
+	"time"
 
 	"github.com/benbjohnson/clock"
+	"github.com/creasty/defaults"
 	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 
+	"github.com/activecm/espy/espy/config"
 	"github.com/activecm/espy/espy/input"
 	"github.com/activecm/espy/espy/output"
 )
 
-// No scheduling, single dump file
+// No rotation schedule, a single dump file per run or checkpoint
 
 // StandardWriter is our standard, single output
 // file, will first write everything to single
 // spool then move them to an appropriate, time
-// stamped log file
+// stamped log file. If a checkpoint interval is set,
+// the spool is also archived and started over on that interval.
+// Closed spool files are compressed in the background.
 type StandardWriter struct {
 	archiveDir string
 	spoolDir   string
@@ -27,38 +32,119 @@ type StandardWriter struct {
 	fs         afero.Fs
 	clock      clock.Clock
 	spoolFiles map[TSVFileType]afero.File
+	compressor compressor
+	namer      archiveNamer
+	// archiver compresses the closed spool files
+	archiver *archiver
+
+	// openTime is when the current spool files were started
+	openTime           time.Time
+	checkpointInterval time.Duration
+	timer              *clock.Timer
+	closed             bool
+	mutex              sync.Mutex
+	// checkpointErr holds the error which stopped the checkpoints, if any
+	checkpointErr error
+	// writeErr holds the first error writing to the spool files, if any
+	writeErr error
 }
 
 // CreateStandardWritingSystem Creates a single shot writer system
-func CreateStandardWritingSystem(fs afero.Fs, clock clock.Clock, tgtDir string) (output.ECSWriter, error) {
-	var err error
+func CreateStandardWritingSystem(fs afero.Fs, clock clock.Clock, tgtDir string) (output.Output, error) {
+	zeekCfg := config.ZeekCfg{}
+	if err := defaults.Set(&zeekCfg); err != nil {
+		return nil, err
+	}
+	zeekCfg.OutputPath = tgtDir
+	return NewStandardWriter(fs, clock, zeekCfg)
+}
+
+// NewStandardWriter creates a single shot writer system which archives
+// its logs in the configured directory when closed
+func NewStandardWriter(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg) (output.Output, error) {
+	return newStandardWriter(fs, clock, zeekCfg, "")
+}
+
+// newStandardWriter creates a single shot writer for the logs of the named
+// agent group, which is used as the Agent when naming archives. The
+// defaultArchiveAgent is used instead if agent is empty.
+func newStandardWriter(fs afero.Fs, clock clock.Clock, zeekCfg config.ZeekCfg, agent string) (output.Output, error) {
+	clock, err := inTimezone(clock, zeekCfg.Timezone)
+	if err != nil {
+		return nil, err
+	}
+	compressor, err := newCompressor(zeekCfg)
+	if err != nil {
+		return nil, err
+	}
+	namer, err := newArchiveNamer(zeekCfg, compressor.extension, agent)
+	if err != nil {
+		return nil, err
+	}
 	w := &StandardWriter{
-		fs:         fs,
-		clock:      clock,
-		archiveDir: tgtDir,
-		spoolDir:   path.Join(tgtDir, "/ecs-spool"),
-		spoolFiles: make(map[TSVFileType]afero.File, len(RegisteredTSVFileTypes)),
+		fs:                 fs,
+		clock:              clock,
+		archiveDir:         zeekCfg.OutputPath,
+		spoolDir:           path.Join(zeekCfg.OutputPath, "/ecs-spool"),
+		spoolFiles:         make(map[TSVFileType]afero.File, len(RegisteredTSVFileTypes)),
+		compressor:         compressor,
+		namer:              namer,
+		checkpointInterval: zeekCfg.CheckpointInterval,
+	}
+	w.archiver = newArchiver(fs, w.archiveDir, path.Join(w.spoolDir, "pending"), compressor, nil)
+
+	// finish archiving the logs a previous run had already closed
+	if err := w.archiver.recoverPending(clock.Now().Location()); err != nil {
+		w.archiver.close()
+		return nil, err
 	}
 
 	for i := range RegisteredTSVFileTypes {
 		fileName := fmt.Sprintf("%s.log", RegisteredTSVFileTypes[i].Header().Path)
 		filePath := path.Join(w.spoolDir, fileName)
-		w.spoolFiles[RegisteredTSVFileTypes[i]], err = OpenTSVFile(fs, clock, RegisteredTSVFileTypes[i], filePath)
+		// archive anything left from a run which was not closed cleanly
+		// rather than appending to it
+		err := w.recoverSpoolFile(RegisteredTSVFileTypes[i], filePath)
+		if err == nil {
+			w.spoolFiles[RegisteredTSVFileTypes[i]], err = OpenTSVFile(fs, clock, RegisteredTSVFileTypes[i], filePath)
+		}
 		if err != nil {
+			w.archiver.close()
 			return nil, err
 		}
 	}
+	w.openTime = clock.Now()
+
+	if w.checkpointInterval > 0 {
+		w.mutex.Lock()
+		w.timer = clock.AfterFunc(w.checkpointInterval, w.checkpoint)
+		w.mutex.Unlock()
+		log.Infof("Archiving logs every %s at: %s", w.checkpointInterval, w.spoolDir)
+	}
 	log.Info("Initialized standard file writer")
 	return w, nil
 }
 
-// WriteECSRecords writes Elastic Common Schema records out to Zeek files
+// WriteECSEvents writes the parsed records of the given events out to Zeek files.
+// The context is not used since the files are written without blocking.
+func (w *StandardWriter) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	return w.WriteECSRecords(RecordsFromEvents(events))
+}
+
+// WriteECSRecords writes Elastic Common Schema records out to Zeek files.
+// Once a write fails, the writer is no longer reported as alive since
+// records may have been lost.
 func (w *StandardWriter) WriteECSRecords(outputData []input.ECSRecord) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
 	log.Debugf("Writing %d records", len(outputData))
 
 	for zeekFileType, groupedData := range MapECSRecordsToTSVFiles(outputData) {
 		err := WriteTSVLines(zeekFileType, groupedData, w.spoolFiles[zeekFileType])
 		if err != nil {
+			if w.writeErr == nil {
+				w.writeErr = err
+			}
 			return err
 		}
 	}
@@ -66,13 +152,76 @@ func (w *StandardWriter) WriteECSRecords(outputData []input.ECSRecord) error {
 	return nil
 }
 
+// Alive returns an error if a checkpoint or a write failed
+func (w *StandardWriter) Alive(ctx context.Context) error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.checkpointErr != nil {
+		return fmt.Errorf("log checkpoints stopped: %v", w.checkpointErr)
+	}
+	if w.writeErr != nil {
+		return fmt.Errorf("writing logs failed: %v", w.writeErr)
+	}
+	return nil
+}
+
+// Ready returns an error if the spool files cannot be written to
+// or if any closed logs could not be archived
+func (w *StandardWriter) Ready(ctx context.Context) error {
+	if err := CheckWritable(w.fs, w.spoolDir); err != nil {
+		return err
+	}
+	return w.archiver.err()
+}
+
 // Close will close all open sessions and rotate everything
 // from spool data to logs
 func (w *StandardWriter) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return nil
+	}
+	if w.timer != nil {
+		w.timer.Stop()
+	}
+	w.closed = true
+	err := w.archiveSpoolFiles(false)
+	// finish compressing the final logs
+	w.archiver.close()
+	return err
+}
+
+// checkpoint archives the logs written since the last checkpoint
+// and schedules the next one
+func (w *StandardWriter) checkpoint() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.closed {
+		return
+	}
+	if err := w.archiveSpoolFiles(true); err != nil {
+		log.WithError(err).Error("Could not archive the logs at the checkpoint, no further checkpoints will be made")
+		w.checkpointErr = err
+		return
+	}
+	w.timer = w.clock.AfterFunc(w.checkpointInterval, w.checkpoint)
+}
+
+// archiveSpoolFiles closes the spool files and queues them to be archived
+// under the times they cover. If reopen is set, new spool files are started
+// in their place. The caller must hold the mutex.
+func (w *StandardWriter) archiveSpoolFiles(reopen bool) error {
+	closeTime := w.clock.Now()
+	job := archiveJob{rotation: Rotation{Dir: w.archiveDir, Start: w.openTime, End: closeTime}}
+	// still archive the files which were closed if one of them fails
+	defer func() { w.archiver.queue(job) }()
 
 	for zeekFileType, spoolFile := range w.spoolFiles {
+		spoolPath := spoolFile.Name()
+
 		// Write the closing footer to our spool file
-		err := WriteTSVFooter(zeekFileType, w.clock.Now(), spoolFile)
+		err := WriteTSVFooter(zeekFileType, closeTime, spoolFile)
 		if err != nil {
 			return err
 		}
@@ -82,39 +231,52 @@ func (w *StandardWriter) Close() error {
 			return err
 		}
 
-		// archive the spool file we just closed out
-		srcFile, err := w.fs.Open(spoolFile.Name())
-		if err != nil {
-			return err
-		}
-
-		archiveName := fmt.Sprintf("%s.log.gz", zeekFileType.Header().Path)
-		archivePath := path.Join(w.archiveDir, archiveName)
-
-		// Open the gzip file and make sure it doesn't exist
-		gzfile, err := w.fs.Create(archivePath)
-		if err != nil {
-			return err
-		}
-		gzout := gzip.NewWriter(gzfile)
-
-		// copy contents from source file to gzip file
-		size, err := io.Copy(gzout, srcFile)
-
-		srcFile.Close()
-		gzout.Close()
-		gzfile.Close()
-
+		// move the spool file aside to be archived in the background
+		archivePath := path.Join(w.archiveDir, w.namer.name(zeekFileType.Header().Path, w.openTime, closeTime, 0))
+		pending, err := w.archiver.stage(spoolPath, archivePath)
 		if err != nil {
 			return err
 		}
+		job.files = append(job.files, pending)
 
-		if err = w.fs.Remove(srcFile.Name()); err != nil {
-			return err
+		if reopen {
+			w.spoolFiles[zeekFileType], err = OpenTSVFile(w.fs, w.clock, zeekFileType, spoolPath)
+			if err != nil {
+				return err
+			}
 		}
+	}
+	w.openTime = closeTime
+	return nil
+}
 
-		log.Infof("Log written: %s    size: %d", archivePath, size)
+// recoverSpoolFile queues a spool file of the given type which was left
+// behind by a previous run to be archived under the times it covers, so
+// that this run does not append to it
+func (w *StandardWriter) recoverSpoolFile(zeekFileType TSVFileType, filePath string) error {
+	spool, ok, err := finishLeftoverSpool(w.fs, zeekFileType, filePath, w.clock.Now().Location())
+	if err != nil || !ok {
+		return err
+	}
+	archivePath := path.Join(w.archiveDir, w.namer.name(zeekFileType.Header().Path, spool.openTime, spool.closeTime, 0))
+	pending, err := w.archiver.stage(filePath, archivePath)
+	if err != nil {
+		return err
 	}
+	log.WithFields(log.Fields{
+		"file":    pending.dst,
+		"opened":  spool.openTime,
+		"closed":  spool.closeTime,
+		"dropped": spool.dropped,
+	}).Warn("Archiving a spool file left by a previous run")
 
+	w.archiver.queue(archiveJob{
+		files: []pendingArchive{pending},
+		rotation: Rotation{
+			Dir:   w.archiveDir,
+			Start: spool.openTime,
+			End:   spool.closeTime,
+		},
+	})
 	return nil
 }
@@ -1,12 +1,19 @@
 package zeek
 
 import (
+	"compress/gzip"
+	"context"
+	"io"
 	"path"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/benbjohnson/clock"
 	"github.com/spf13/afero"
 	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/input"
 )
 
 func TestOpenStandardFiles(t *testing.T) {
@@ -26,15 +33,137 @@ func TestOpenStandardFiles(t *testing.T) {
 func TestCloseStandardFiles(t *testing.T) {
 	fs := afero.NewMemMapFs()
 	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
 	w, err := CreateStandardWritingSystem(fs, clock, "/opt/zeek/logs")
 	require.Nil(t, err, "Should be able to open spool files")
+	clock.Set(time.Date(2022, 02, 14, 17, 20, 0, 0, time.UTC))
 	w.Close()
 	require.Nil(t, err, "Should be able to close spool files and open archive files")
 	for _, zeekFileType := range RegisteredTSVFileTypes {
 		zeekPath := zeekFileType.Header().Path
-		archivePath := path.Join("/opt/zeek/logs", zeekPath+".log.gz")
+		archivePath := path.Join("/opt/zeek/logs/2022-02-14", zeekPath+".16:17:18-17:20:00.log.gz")
 		testVal, testErr := afero.Exists(fs, archivePath)
 		require.Nil(t, testErr, "Archive file for "+zeekPath+" log should exist")
 		require.True(t, testVal, "Archive file for "+zeekPath+" log should exist")
 	}
 }
+
+func TestStandardRunsDoNotOverwrite(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLogs = false
+
+	// two runs within the same second
+	for i := 0; i < 2; i++ {
+		w, err := NewStandardWriter(fs, clock, zeekCfg)
+		require.Nil(t, err)
+		require.Nil(t, w.(*StandardWriter).WriteECSRecords(testConnRecords(clock, i+1)))
+		require.Nil(t, w.Close())
+	}
+	// and a run which stopped without closing its logs
+	w, err := NewStandardWriter(fs, clock, zeekCfg)
+	require.Nil(t, err)
+	require.Nil(t, w.(*StandardWriter).WriteECSRecords(testConnRecords(clock, 3)))
+
+	clock.Set(time.Date(2022, 02, 14, 18, 0, 0, 0, time.UTC))
+	w, err = NewStandardWriter(fs, clock, zeekCfg)
+	require.Nil(t, err)
+	require.Nil(t, w.Close())
+
+	for archive, count := range map[string]int{
+		"conn.16:17:18-16:17:18.log.gz":      1,
+		"conn.16:17:18-16:17:18.dup1.log.gz": 2,
+		"conn.16:17:18-16:17:18.dup2.log.gz": 3,
+		"conn.18:00:00-18:00:00.log.gz":      0,
+	} {
+		contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/"+archive)
+		require.Equal(t, count, strings.Count(contents, "\t10.0.0.1\t"), archive)
+	}
+}
+
+func TestStandardCheckpoint(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLogs = false
+	zeekCfg.CheckpointInterval = 30 * time.Minute
+	zeekCfg.ArchiveName = ArchiveNameZeekctlNoColon
+	w, err := NewStandardWriter(fs, clock, zeekCfg)
+	require.Nil(t, err)
+	writer := w.(*StandardWriter)
+
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 2)))
+	clock.Add(30 * time.Minute)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 3)))
+	clock.Add(10 * time.Minute)
+	require.Nil(t, w.Close())
+	require.Nil(t, writer.Alive(context.Background()))
+
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16-17-18_16-47-18.log.gz")
+	require.Equal(t, 2, strings.Count(contents, "\t10.0.0.1\t"))
+	contents = readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16-47-18_16-57-18.log.gz")
+	require.Equal(t, 3, strings.Count(contents, "\t10.0.0.1\t"))
+
+	// no checkpoints are made once closed
+	clock.Add(time.Hour)
+	exists, err := afero.Exists(fs, "/opt/zeek/logs/2022-02-14/conn.16-57-18_17-27-18.log.gz")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestStandardSkipsMalformedRecords(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLogs = false
+	w, err := NewStandardWriter(fs, clock, zeekCfg)
+	require.Nil(t, err)
+
+	records := testConnRecords(clock, 6)
+	records[3].Timestamp = time.Time{}
+	records[3].RFCTimestamp = "2022-02-14 16:17:18"
+	events := make([]input.ECSEvent, len(records))
+	for i := range records {
+		events[i] = input.ECSEvent{Key: "net-data:sysmon", Record: records[i]}
+	}
+	require.Nil(t, w.WriteECSEvents(context.Background(), events))
+	require.Nil(t, w.Close())
+
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16:17:18-16:17:18.log.gz")
+	require.Equal(t, 5, strings.Count(contents, "\t10.0.0.1\t"), "Only the malformed record should be dropped from the batch")
+}
+
+func TestStandardCheckpointInBackground(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	zeekCfg := newTestZeekCfg(t)
+	zeekCfg.RotateLogs = false
+	zeekCfg.CheckpointInterval = 30 * time.Minute
+	w, err := NewStandardWriter(fs, clock, zeekCfg)
+	require.Nil(t, err)
+	writer := w.(*StandardWriter)
+
+	// hold up compression until the test is done writing
+	release := make(chan struct{})
+	writer.archiver.compressor = compressor{
+		extension: ".log.gz",
+		newWriter: func(w io.Writer) (io.WriteCloser, error) {
+			<-release
+			return gzip.NewWriter(w), nil
+		},
+	}
+
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 2)))
+	clock.Add(30 * time.Minute)
+	require.Nil(t, writer.WriteECSRecords(testConnRecords(clock, 3)), "Writing should not wait on compressing the checkpoint")
+
+	close(release)
+	require.Nil(t, w.Close())
+	contents := readArchive(t, fs, "/opt/zeek/logs/2022-02-14/conn.16:17:18-16:47:18.log.gz")
+	require.Equal(t, 2, strings.Count(contents, "\t10.0.0.1\t"))
+}
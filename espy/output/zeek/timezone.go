@@ -0,0 +1,34 @@
+package zeek
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/benbjohnson/clock"
+)
+
+// zonedClock reports the time in a fixed time zone so that the archive
+// names, the #open and #close times and the rotation schedule agree
+// regardless of the time zone of the host
+type zonedClock struct {
+	clock.Clock
+	location *time.Location
+}
+
+// Now returns the current time in the clock's time zone
+func (c zonedClock) Now() time.Time {
+	return c.Clock.Now().In(c.location)
+}
+
+// inTimezone wraps a clock to report the time in the named time zone.
+// The clock is returned as is if no time zone is named.
+func inTimezone(clock clock.Clock, timezone string) (clock.Clock, error) {
+	if timezone == "" {
+		return clock, nil
+	}
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Zeek Timezone %q: %v", timezone, err)
+	}
+	return zonedClock{Clock: clock, location: location}, nil
+}
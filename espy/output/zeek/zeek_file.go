@@ -10,7 +10,9 @@ import (
 	"time"
 
 	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
 	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 )
 
@@ -102,6 +104,18 @@ func MapECSRecordsToTSVFiles(ecsRecords []input.ECSRecord) map[TSVFileType][]inp
 	return outputMap
 }
 
+//RecordsFromEvents returns the parsed ECS records of the given events,
+//skipping any events whose ECS fields could not be parsed
+func RecordsFromEvents(events []input.ECSEvent) []input.ECSRecord {
+	records := make([]input.ECSRecord, 0, len(events))
+	for i := range events {
+		if events[i].RecordErr == nil {
+			records = append(records, events[i].Record)
+		}
+	}
+	return records
+}
+
 //WriteTSVHeader writes out the header for a newly opened Zeek TSV file of the given type
 func WriteTSVHeader(fileType TSVFileType, openTime time.Time, fileWriter io.Writer) error {
 	fileHeader := fileType.Header().WithOpenTime(openTime).String()
@@ -111,14 +125,17 @@ func WriteTSVHeader(fileType TSVFileType, openTime time.Time, fileWriter io.Writ
 	return nil
 }
 
-//WriteTSVLines writes out Elastic Common Schema records as lines of the given Zeek TSV file type to the given writer
+//WriteTSVLines writes out Elastic Common Schema records as lines of the given Zeek TSV file type to the given writer.
+//Records with a malformed timestamp are logged and skipped so they do not hold up the rest of the batch.
 func WriteTSVLines(fileType TSVFileType, outputData []input.ECSRecord, fileWriter io.Writer) error {
+	outputData = dropMalformedRecords(fileType, outputData)
 	if len(outputData) == 0 {
 		return nil
 	}
 
 	writeString, err := fileType.FormatLines(outputData)
 	if err != nil {
+		metrics.ParseFailures.WithLabelValues(metrics.StageZeek).Inc()
 		return err
 	}
 
@@ -126,9 +143,35 @@ func WriteTSVLines(fileType TSVFileType, outputData []input.ECSRecord, fileWrite
 		return err
 	}
 
+	metrics.ZeekRecordsWritten.WithLabelValues(fileType.Header().Path).Add(float64(len(outputData)))
 	return nil
 }
 
+//dropMalformedRecords returns the records whose timestamp can be parsed, logging the others
+func dropMalformedRecords(fileType TSVFileType, outputData []input.ECSRecord) []input.ECSRecord {
+	var valid []input.ECSRecord
+	for i := range outputData {
+		if _, err := outputData[i].Time(); err != nil {
+			if valid == nil {
+				valid = append(make([]input.ECSRecord, 0, len(outputData)), outputData[:i]...)
+			}
+			metrics.ParseFailures.WithLabelValues(metrics.StageZeek).Inc()
+			log.WithError(err).WithFields(log.Fields{
+				"path":      fileType.Header().Path,
+				"timestamp": outputData[i].RFCTimestamp,
+			}).Error("Could not write a record with a malformed timestamp")
+			continue
+		}
+		if valid != nil {
+			valid = append(valid, outputData[i])
+		}
+	}
+	if valid == nil {
+		return outputData
+	}
+	return valid
+}
+
 //WriteTSVFooter writes out the footer for a Zeek TSV file of the given type
 func WriteTSVFooter(fileType TSVFileType, closeTime time.Time, fileWriter io.Writer) error {
 	header := fileType.Header()
@@ -140,6 +183,17 @@ func WriteTSVFooter(fileType TSVFileType, closeTime time.Time, fileWriter io.Wri
 	return nil
 }
 
+//CheckWritable returns an error if new files cannot be created in the given directory
+func CheckWritable(fs afero.Fs, directory string) error {
+	file, err := afero.TempFile(fs, directory, ".espy-healthcheck")
+	if err != nil {
+		return fmt.Errorf("%s is not writable: %v", directory, err)
+	}
+	name := file.Name()
+	file.Close()
+	return fs.Remove(name)
+}
+
 //OpenTSVFile opens a Zeek TSV file at the given file path. If the file does not exist,
 //this function creates the file and writes out the appropriate Zeek TSV header as described
 //by the given Zeek file type.
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/monitor"
+	"github.com/activecm/espy/espy/output"
+)
+
+// outputSet tracks the running outputs and the settings they were
+// created with so that a reload only restarts the outputs which changed
+type outputSet struct {
+	env    output.Environment
+	server *monitor.Server
+
+	configs map[string]config.OutputCfg
+	outputs map[string]output.Output
+}
+
+func newOutputSet(env output.Environment, server *monitor.Server) *outputSet {
+	return &outputSet{
+		env:     env,
+		server:  server,
+		configs: make(map[string]config.OutputCfg),
+		outputs: make(map[string]output.Output),
+	}
+}
+
+// unchanged returns the names of the running outputs whose
+// settings are the same in the given configuration
+func (s *outputSet) unchanged(conf *config.Config) map[string]bool {
+	keep := make(map[string]bool)
+	for i := range conf.S.Outputs {
+		name := conf.S.Outputs[i].Name
+		if old, ok := s.configs[name]; ok && reflect.DeepEqual(old, conf.S.Outputs[i]) {
+			keep[name] = true
+		}
+	}
+	return keep
+}
+
+// open returns the outputs for the given configuration in the order they
+// are configured. Outputs named in keep are reused and the rest are created.
+// The running outputs which are not kept must already be closed.
+func (s *outputSet) open(conf *config.Config, keep map[string]bool) (output.MultiOutput, error) {
+	var outputs output.MultiOutput
+	var opened output.MultiOutput
+	for i := range conf.S.Outputs {
+		static := conf.S.Outputs[i]
+		if keep[static.Name] {
+			outputs = append(outputs, output.NamedOutput{Name: static.Name, Output: s.outputs[static.Name]})
+			continue
+		}
+
+		log.WithField("type", static.Type).Infof("Enabling output %s", static.Name)
+		out, err := output.New(static, conf.R.Outputs[i], s.env)
+		if err != nil {
+			log.WithError(err).WithField("output", static.Name).Error("Failed to initialize output.")
+			opened.Close()
+			return nil, err
+		}
+		named := output.NamedOutput{Name: static.Name, Output: out}
+		outputs = append(outputs, named)
+		opened = append(opened, named)
+	}
+
+	// forget the outputs which were closed and remember the new ones
+	for name := range s.configs {
+		if !keep[name] {
+			delete(s.configs, name)
+			delete(s.outputs, name)
+			if s.server != nil {
+				s.server.RemoveChecks(name)
+			}
+		}
+	}
+	for i := range conf.S.Outputs {
+		static := conf.S.Outputs[i]
+		if keep[static.Name] {
+			continue
+		}
+		s.configs[static.Name] = static
+		s.outputs[static.Name] = outputs[i].Output
+		if checker, ok := outputs[i].Output.(output.HealthChecker); ok && s.server != nil {
+			s.server.AddLivenessCheck(static.Name, checker.Alive)
+			s.server.AddReadinessCheck(static.Name, checker.Ready)
+		}
+	}
+	return outputs, nil
+}
+
+// outputNames returns the names of the configured outputs in order
+func outputNames(conf *config.Config) []string {
+	names := make([]string, len(conf.S.Outputs))
+	for i := range conf.S.Outputs {
+		names[i] = conf.S.Outputs[i].Name
+	}
+	return names
+}
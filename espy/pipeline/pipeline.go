@@ -0,0 +1,381 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/metrics"
+	"github.com/activecm/espy/espy/output"
+)
+
+// ErrNoMessage is returned by a Source when no message arrived before its read timed out
+var ErrNoMessage = errors.New("no message available")
+
+// ErrNotRunning is returned when reconfiguring a Pipeline which is not running
+var ErrNotRunning = errors.New("pipeline is not running")
+
+// Message is a raw event read from a Source
+type Message struct {
+	// Key is the name of the Redis list the message was read from
+	Key  string
+	Data string
+}
+
+// Source provides the raw events processed by the Pipeline
+type Source interface {
+	// Read blocks until a message is available, the read times out,
+	// or the context is cancelled
+	Read(ctx context.Context) (Message, error)
+}
+
+// Pipeline moves events from a Source to a set of outputs in stages
+// connected by bounded channels:
+//
+//	reader -> decoders -> per-output writers
+//
+// A single reader pulls messages from the Source, a pool of decoders
+// parses them and routes them to the outputs, and each output has its own
+// writer goroutine. Every channel is bounded and every send blocks, so a
+// slow output fills its queue and then slows reading rather than dropping
+// events. Since the decoders run concurrently, events may reach the
+// outputs in a slightly different order than they were read.
+type Pipeline struct {
+	source  Source
+	outputs output.MultiOutput
+	cfg     config.PipelineCfg
+
+	messages chan Message
+
+	// mu guards the router and writers, which are replaced by Reconfigure.
+	// The decoders hold a read lock while routing an event.
+	mu        sync.RWMutex
+	router    *output.Router
+	writers   []*writer
+	running   bool
+	writersWG sync.WaitGroup
+
+	// abandon is closed when draining takes longer than the drain timeout
+	abandon chan struct{}
+	dropped int64
+	// writeCtx is passed to the outputs and is cancelled along with
+	// abandon so that writes in progress give up
+	writeCtx     context.Context
+	cancelWrites context.CancelFunc
+}
+
+// writer feeds the events queued for an output to it
+type writer struct {
+	output.NamedOutput
+	queue chan input.ECSEvent
+	done  chan struct{}
+	// ctx is cancelled to give up on the writes to this output
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+// closedOutput stands in for an output which was closed by a
+// reconfiguration that failed to open its replacement
+type closedOutput struct{}
+
+func (closedOutput) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	return errors.New("output was closed by a failed configuration reload")
+}
+
+func (closedOutput) Close() error {
+	return nil
+}
+
+// New creates a Pipeline which reads from source and writes to outputs
+// as chosen by router. The pipeline takes ownership of the outputs.
+func New(source Source, outputs output.MultiOutput, router *output.Router, cfg config.PipelineCfg) *Pipeline {
+	if cfg.Decoders < 1 {
+		cfg.Decoders = 1
+	}
+	if cfg.QueueSize < 1 {
+		cfg.QueueSize = 1
+	}
+	if cfg.BatchSize < 1 {
+		cfg.BatchSize = 1
+	}
+	return &Pipeline{
+		source:  source,
+		outputs: outputs,
+		router:  router,
+		cfg:     cfg,
+	}
+}
+
+// Run processes events until the context is cancelled or the Source
+// fails. Before returning, Run drains every stage and closes the outputs.
+// If draining takes longer than the configured DrainTimeout, the remaining
+// events are dropped so the outputs can be closed. The error from the
+// Source, if any, is returned.
+func (p *Pipeline) Run(ctx context.Context) error {
+	p.messages = make(chan Message, p.cfg.QueueSize)
+	p.abandon = make(chan struct{})
+	p.writeCtx, p.cancelWrites = context.WithCancel(context.Background())
+	defer p.cancelWrites()
+
+	// start from the end of the pipeline so every stage has a consumer
+	p.mu.Lock()
+	for i := range p.outputs {
+		p.writers = append(p.writers, p.startWriter(p.outputs[i]))
+	}
+	p.running = true
+	p.mu.Unlock()
+
+	var decoders sync.WaitGroup
+	for i := 0; i < p.cfg.Decoders; i++ {
+		decoders.Add(1)
+		go func() {
+			defer decoders.Done()
+			p.decode()
+		}()
+	}
+
+	pending, readErr := p.read(ctx)
+
+	// drain the pipeline stage by stage
+	log.Debug("Draining pipeline")
+	if p.cfg.DrainTimeout > 0 {
+		timer := time.AfterFunc(p.cfg.DrainTimeout, func() {
+			log.Warnf("Could not drain the pipeline within %s, dropping the remaining events.", p.cfg.DrainTimeout)
+			close(p.abandon)
+			p.cancelWrites()
+		})
+		defer timer.Stop()
+	}
+	if pending != nil {
+		select {
+		case p.messages <- *pending:
+		case <-p.abandon:
+			atomic.AddInt64(&p.dropped, 1)
+		}
+	}
+	close(p.messages)
+	decoders.Wait()
+
+	p.mu.Lock()
+	p.running = false
+	for _, w := range p.writers {
+		close(w.queue)
+	}
+	p.mu.Unlock()
+	p.writersWG.Wait()
+
+	if dropped := atomic.LoadInt64(&p.dropped); dropped > 0 {
+		log.Warnf("Dropped %d events while shutting down.", dropped)
+	}
+	return readErr
+}
+
+// Reconfigure switches a running Pipeline to new outputs and routing rules.
+// Decoding pauses while the outputs are switched. Running outputs whose
+// names are not in keep are drained and closed before open is called, so
+// their replacements may safely reuse the same files. Events which cannot
+// be written to them within the DrainTimeout are dropped. open returns the new
+// list of outputs and a router for them. Outputs in the new list which are
+// named in keep continue with their running writer and any events already
+// queued for them.
+//
+// If open fails, the closed outputs are not replaced and events routed
+// to them are discarded, so the caller should shut the Pipeline down.
+func (p *Pipeline) Reconfigure(keep map[string]bool, open func() (output.MultiOutput, *output.Router, error)) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.running {
+		return ErrNotRunning
+	}
+
+	kept := make(map[string]*writer)
+	for i, w := range p.writers {
+		if keep[w.Name] {
+			kept[w.Name] = w
+			continue
+		}
+		log.WithField("output", w.Name).Info("Closing output for reload")
+		w.stop(p.cfg.DrainTimeout)
+		p.writers[i] = p.startWriter(output.NamedOutput{Name: w.Name, Output: closedOutput{}})
+	}
+
+	outputs, router, err := open()
+	if err != nil {
+		return err
+	}
+
+	writers := make([]*writer, 0, len(outputs))
+	for i := range outputs {
+		if w, ok := kept[outputs[i].Name]; ok {
+			writers = append(writers, w)
+			delete(kept, outputs[i].Name)
+			continue
+		}
+		writers = append(writers, p.startWriter(outputs[i]))
+	}
+	// close any kept outputs which were left out of the new list
+	for _, w := range kept {
+		close(w.queue)
+	}
+	// retire the placeholders for the closed outputs
+	for _, w := range p.writers {
+		if _, ok := w.Output.(closedOutput); ok {
+			close(w.queue)
+		}
+	}
+
+	p.writers = writers
+	p.router = router
+	return nil
+}
+
+// startWriter starts a goroutine which writes queued events to an output
+// until its queue is closed
+func (p *Pipeline) startWriter(out output.NamedOutput) *writer {
+	w := &writer{
+		NamedOutput: out,
+		queue:       make(chan input.ECSEvent, p.cfg.QueueSize),
+		done:        make(chan struct{}),
+	}
+	w.ctx, w.cancel = context.WithCancel(p.writeCtx)
+	p.writersWG.Add(1)
+	go func() {
+		defer p.writersWG.Done()
+		defer close(w.done)
+		defer w.cancel()
+		p.write(w)
+	}()
+	return w
+}
+
+// stop closes the writer's queue and waits for it to write out the queued
+// events and close its output. If that takes longer than the timeout, the
+// write in progress is cancelled and the remaining events are dropped.
+func (w *writer) stop(timeout time.Duration) {
+	close(w.queue)
+	if timeout > 0 {
+		timer := time.AfterFunc(timeout, func() {
+			log.WithField("output", w.Name).Warnf("Could not drain the output within %s, dropping the remaining events.", timeout)
+			w.cancel()
+		})
+		defer timer.Stop()
+	}
+	<-w.done
+}
+
+// read pulls messages from the Source until the context is cancelled
+// or the Source fails. If the context is cancelled while waiting for
+// the decoders, the message which was read is returned so it can be
+// handed off while draining.
+func (p *Pipeline) read(ctx context.Context) (*Message, error) {
+	for !isContextCancelled(ctx) {
+		msg, err := p.source.Read(ctx)
+		if err == ErrNoMessage {
+			// Read timeout but no exit signal, keep polling
+			log.WithError(err).Debug("Timed out while polling for data.")
+			continue
+		} else if err != nil {
+			if isContextCancelled(ctx) {
+				return nil, nil
+			}
+			log.WithError(err).Error("Could not read data from Redis.")
+			return nil, err
+		}
+
+		metrics.EventsRead.WithLabelValues(msg.Key).Inc()
+
+		select {
+		// blocks while the decoders are busy, providing backpressure
+		case p.messages <- msg:
+		case <-ctx.Done():
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+
+// decode parses messages and hands the events to their outputs' queues
+func (p *Pipeline) decode() {
+	var decoder input.Decoder
+	for msg := range p.messages {
+		event, err := decoder.Decode(msg.Key, msg.Data)
+		if err != nil {
+			metrics.ParseFailures.WithLabelValues(metrics.StageJSON).Inc()
+			log.WithError(err).WithField("input", msg.Data).Error("Could not parse event.")
+			continue
+		}
+		if event.RecordErr != nil {
+			metrics.ParseFailures.WithLabelValues(metrics.StageECS).Inc()
+			log.WithError(event.RecordErr).WithField("input", msg.Data).Error("Could not parse ECS data.")
+		}
+
+		p.mu.RLock()
+		for _, idx := range p.router.Route(&event) {
+			select {
+			// blocks while the output's queue is full, providing backpressure
+			case p.writers[idx].queue <- event:
+			case <-p.abandon:
+				atomic.AddInt64(&p.dropped, 1)
+			}
+		}
+		p.mu.RUnlock()
+	}
+}
+
+// write hands queued events to an output in batches until the
+// queue is closed, then closes the output
+func (p *Pipeline) write(w *writer) {
+	batch := make([]input.ECSEvent, 0, p.cfg.BatchSize)
+	for event := range w.queue {
+		if p.isAbandoned() || w.ctx.Err() != nil {
+			atomic.AddInt64(&p.dropped, 1)
+			continue
+		}
+
+		batch = append(batch[:0], event)
+		// gather up any other events which are already waiting
+	gather:
+		for len(batch) < p.cfg.BatchSize {
+			select {
+			case event, ok := <-w.queue:
+				if !ok {
+					break gather
+				}
+				batch = append(batch, event)
+			default:
+				break gather
+			}
+		}
+		w.WriteOrLog(w.ctx, batch)
+	}
+
+	if err := w.Close(); err != nil {
+		log.WithError(err).WithField("output", w.Name).Error("Error encountered while closing output.")
+	}
+}
+
+// isAbandoned returns true once draining has taken longer than the drain timeout
+func (p *Pipeline) isAbandoned() bool {
+	select {
+	case <-p.abandon:
+		return true
+	default:
+	}
+	return false
+}
+
+// isContextCancelled returns true if a context has been cancelled
+func isContextCancelled(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return true
+	default:
+	}
+	return false
+}
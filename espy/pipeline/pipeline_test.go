@@ -0,0 +1,251 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/input"
+	"github.com/activecm/espy/espy/output"
+)
+
+// sliceSource hands out a fixed set of messages then times out until cancelled
+type sliceSource struct {
+	mutex    sync.Mutex
+	messages []Message
+	reads    int
+}
+
+func (s *sliceSource) Read(ctx context.Context) (Message, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reads < len(s.messages) {
+		s.reads++
+		return s.messages[s.reads-1], nil
+	}
+	return Message{}, ErrNoMessage
+}
+
+func (s *sliceSource) add(messages ...Message) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.messages = append(s.messages, messages...)
+}
+
+func (s *sliceSource) readCount() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.reads
+}
+
+// countingOutput counts the events written to it. If gate is set, each
+// write blocks until the gate is closed or the write is cancelled.
+type countingOutput struct {
+	mutex  sync.Mutex
+	events int
+	closed bool
+	gate   chan struct{}
+}
+
+func (c *countingOutput) WriteECSEvents(ctx context.Context, events []input.ECSEvent) error {
+	if c.gate != nil {
+		select {
+		case <-c.gate:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.events += len(events)
+	return nil
+}
+
+func (c *countingOutput) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *countingOutput) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func (c *countingOutput) count() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.events
+}
+
+func newTestSource(count int) *sliceSource {
+	source := &sliceSource{}
+	for i := 0; i < count; i++ {
+		source.messages = append(source.messages, Message{
+			Key:  "net-data:sysmon",
+			Data: fmt.Sprintf(`{"@metadata": {"version": "7.10.0"}, "event": {"code": %d}}`, i),
+		})
+	}
+	return source
+}
+
+func newTestPipeline(t *testing.T, source Source, outputs output.MultiOutput, cfg config.PipelineCfg) *Pipeline {
+	names := make([]string, len(outputs))
+	for i := range outputs {
+		names[i] = outputs[i].Name
+	}
+	router, err := output.NewRouter(config.RoutingCfg{}, names)
+	require.Nil(t, err)
+	return New(source, outputs, router, cfg)
+}
+
+func TestPipelineDrainsOnClose(t *testing.T) {
+	source := newTestSource(500)
+	zeek := &countingOutput{}
+	es := &countingOutput{}
+	p := newTestPipeline(t, source, output.MultiOutput{
+		{Name: "zeek", Output: zeek},
+		{Name: "elasticsearch", Output: es},
+	}, config.PipelineCfg{Decoders: 4, QueueSize: 10, BatchSize: 8})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	require.Eventually(t, func() bool { return source.readCount() == 500 }, time.Second, time.Millisecond)
+	cancel()
+	require.Nil(t, <-done)
+
+	require.Equal(t, 500, zeek.count(), "Every event should be written before Run returns")
+	require.Equal(t, 500, es.count(), "Every event should be written before Run returns")
+	require.True(t, zeek.closed)
+	require.True(t, es.closed)
+}
+
+func TestPipelineBackpressure(t *testing.T) {
+	source := newTestSource(500)
+	fast := &countingOutput{}
+	slow := &countingOutput{gate: make(chan struct{})}
+	cfg := config.PipelineCfg{Decoders: 2, QueueSize: 5, BatchSize: 1}
+	p := newTestPipeline(t, source, output.MultiOutput{
+		{Name: "fast", Output: fast},
+		{Name: "slow", Output: slow},
+	}, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+
+	// the slow output's writer holds one batch, its queue holds QueueSize events,
+	// each decoder holds one event, the message queue holds QueueSize messages,
+	// and the reader holds one message
+	maxInFlight := cfg.BatchSize + cfg.QueueSize + cfg.Decoders + cfg.QueueSize + 1
+	time.Sleep(50 * time.Millisecond)
+	require.LessOrEqual(t, source.readCount(), maxInFlight, "A blocked output should pause reading")
+
+	close(slow.gate)
+	require.Eventually(t, func() bool { return source.readCount() == 500 }, time.Second, time.Millisecond)
+	cancel()
+	require.Nil(t, <-done)
+	require.Equal(t, 500, slow.count(), "No events should be dropped while the output is blocked")
+	require.Equal(t, 500, fast.count())
+}
+
+func TestPipelineReconfigure(t *testing.T) {
+	source := newTestSource(100)
+	kept := &countingOutput{}
+	removed := &countingOutput{}
+	p := newTestPipeline(t, source, output.MultiOutput{
+		{Name: "kept", Output: kept},
+		{Name: "removed", Output: removed},
+	}, config.PipelineCfg{Decoders: 2, QueueSize: 10, BatchSize: 8})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	require.Eventually(t, func() bool { return kept.count() == 100 }, time.Second, time.Millisecond)
+
+	added := &countingOutput{}
+	err := p.Reconfigure(map[string]bool{"kept": true}, func() (output.MultiOutput, *output.Router, error) {
+		require.True(t, removed.isClosed(), "Outputs which are not kept should be closed before opening new ones")
+		outputs := output.MultiOutput{{Name: "added", Output: added}, {Name: "kept"}}
+		router, err := output.NewRouter(config.RoutingCfg{}, []string{"added", "kept"})
+		return outputs, router, err
+	})
+	require.Nil(t, err)
+	require.False(t, kept.isClosed(), "Unchanged outputs should keep running")
+
+	source.add(newTestSource(50).messages...)
+	require.Eventually(t, func() bool { return source.readCount() == 150 }, time.Second, time.Millisecond)
+	cancel()
+	require.Nil(t, <-done)
+
+	require.Equal(t, 150, kept.count())
+	require.Equal(t, 100, removed.count())
+	require.Equal(t, 50, added.count())
+	require.True(t, kept.isClosed())
+	require.True(t, added.isClosed())
+}
+
+func TestPipelineDrainTimeout(t *testing.T) {
+	source := newTestSource(100)
+	stuck := &countingOutput{gate: make(chan struct{})}
+	cfg := config.PipelineCfg{Decoders: 1, QueueSize: 10, BatchSize: 1, DrainTimeout: 20 * time.Millisecond}
+	p := newTestPipeline(t, source, output.MultiOutput{{Name: "stuck", Output: stuck}}, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+
+	// the write in progress when the drain times out is cancelled and the rest are dropped
+	select {
+	case err := <-done:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("A write in progress should be cancelled once the drain times out")
+	}
+	require.Equal(t, 0, stuck.count())
+	require.True(t, stuck.isClosed(), "Outputs should be closed even if draining times out")
+}
+
+func TestPipelineReconfigureDrainTimeout(t *testing.T) {
+	source := newTestSource(10)
+	stuck := &countingOutput{gate: make(chan struct{})}
+	cfg := config.PipelineCfg{Decoders: 1, QueueSize: 10, BatchSize: 1, DrainTimeout: 20 * time.Millisecond}
+	p := newTestPipeline(t, source, output.MultiOutput{{Name: "stuck", Output: stuck}}, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- p.Run(ctx) }()
+	require.Eventually(t, func() bool { return source.readCount() == 10 }, time.Second, time.Millisecond)
+
+	replacement := &countingOutput{}
+	reconfigured := make(chan error)
+	go func() {
+		reconfigured <- p.Reconfigure(nil, func() (output.MultiOutput, *output.Router, error) {
+			outputs := output.MultiOutput{{Name: "stuck", Output: replacement}}
+			router, err := output.NewRouter(config.RoutingCfg{}, []string{"stuck"})
+			return outputs, router, err
+		})
+	}()
+	select {
+	case err := <-reconfigured:
+		require.Nil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Closing a stuck output for a reload should give up after the drain timeout")
+	}
+	require.True(t, stuck.isClosed())
+
+	cancel()
+	require.Nil(t, <-done)
+	require.True(t, replacement.isClosed())
+}
@@ -0,0 +1,39 @@
+package pipeline
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// RedisSource reads events from a set of Redis lists
+type RedisSource struct {
+	Client *redis.Client
+	Keys   []string
+	// Timeout is how long a single read waits for data to arrive
+	Timeout time.Duration
+}
+
+// Read pops the next event off of the Redis lists
+func (r RedisSource) Read(ctx context.Context) (Message, error) {
+	netMessage, err := r.Client.BLPop(ctx, r.Timeout, r.Keys...).Result()
+	if err == redis.Nil {
+		return Message{}, ErrNoMessage
+	} else if err != nil {
+		return Message{}, err
+	}
+	return Message{Key: netMessage[0], Data: netMessage[1]}, nil
+}
+
+// Ping returns an error if Redis cannot be reached or rejects our credentials
+func (r RedisSource) Ping(ctx context.Context) error {
+	return r.Client.Ping(ctx).Err()
+}
+
+// ListLength returns the number of events waiting in the given Redis list
+func (r RedisSource) ListLength(key string) (int64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.Timeout)
+	defer cancel()
+	return r.Client.LLen(ctx, key).Result()
+}
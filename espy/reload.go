@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/output"
+	"github.com/activecm/espy/espy/pipeline"
+)
+
+// reloadOnHangup reloads the configuration file each time the program
+// receives SIGHUP until the context is cancelled. If the pipeline cannot be
+// switched to the new outputs, shutdown is called to stop espy cleanly.
+func reloadOnHangup(ctx context.Context, p *pipeline.Pipeline, outputs *outputSet, conf *config.Config, shutdown func()) {
+	// the channel stays registered after returning so that a late
+	// SIGHUP is ignored rather than terminating espy mid shutdown
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-c:
+		}
+
+		log.Info("Reloading configuration.")
+		newConf, err := config.LoadConfig(*configFlag)
+		if err != nil {
+			log.WithError(err).Error("Could not load configuration file, keeping the current configuration.")
+			continue
+		}
+		router, err := output.NewRouter(newConf.S.Routing, outputNames(newConf))
+		if err != nil {
+			log.WithError(err).Error("Invalid routing rules, keeping the current configuration.")
+			continue
+		}
+		warnRestartRequired(conf.S, newConf.S)
+		log.SetLevel(log.Level(newConf.S.LogLevel))
+
+		// outputs whose settings did not change keep running along with
+		// their spool files, the rest are closed and opened again
+		keep := outputs.unchanged(newConf)
+		err = p.Reconfigure(keep, func() (output.MultiOutput, *output.Router, error) {
+			newOutputs, err := outputs.open(newConf, keep)
+			return newOutputs, router, err
+		})
+		if err == pipeline.ErrNotRunning {
+			log.Warn("Events are not being processed, the configuration was not reloaded.")
+			continue
+		} else if err != nil {
+			log.WithError(err).Error("Could not apply the new configuration. Shutting down.")
+			shutdown()
+			return
+		}
+		conf = newConf
+		log.Info("Configuration reloaded.")
+	}
+}
+
+// warnRestartRequired logs the settings which changed in the configuration
+// file but cannot be applied without restarting espy
+func warnRestartRequired(current, updated config.StaticCfg) {
+	sections := []struct {
+		name             string
+		current, updated interface{}
+	}{
+		{"Redis", current.Redis, updated.Redis},
+		{"Pipeline", current.Pipeline, updated.Pipeline},
+		{"Monitoring", current.Monitoring, updated.Monitoring},
+	}
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.current, section.updated) {
+			log.Warnf("Changes to the %s settings take effect after espy is restarted.", section.name)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	log "github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+	"github.com/spf13/afero"
+	"github.com/stretchr/testify/require"
+
+	"github.com/activecm/espy/espy/config"
+	"github.com/activecm/espy/espy/output"
+	"github.com/activecm/espy/espy/pipeline"
+)
+
+func TestMain(m *testing.M) {
+	// LoadConfig needs the version which is filled in at build time
+	config.Version = "v0.0.0"
+	os.Exit(m.Run())
+}
+
+// idleSource never has any messages. started is closed once
+// the pipeline has begun reading.
+type idleSource struct {
+	started chan struct{}
+	once    sync.Once
+}
+
+func (s *idleSource) Read(ctx context.Context) (pipeline.Message, error) {
+	s.once.Do(func() { close(s.started) })
+	select {
+	case <-ctx.Done():
+	case <-time.After(10 * time.Millisecond):
+	}
+	return pipeline.Message{}, pipeline.ErrNoMessage
+}
+
+// writeTestConfig writes a config file at the info log level with the given pipeline queue size
+// and a Zeek output for each pair of output name and log directory
+func writeTestConfig(t *testing.T, configPath string, queueSize int, outputs ...string) {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "LogLevel: 4\nPipeline:\n  QueueSize: %d\nOutputs:\n", queueSize)
+	for i := 0; i < len(outputs); i += 2 {
+		fmt.Fprintf(&builder, "  - Type: zeek\n    Name: %s\n    Zeek:\n      Path: %s\n      Rotate: false\n", outputs[i], outputs[i+1])
+	}
+	require.Nil(t, ioutil.WriteFile(configPath, []byte(builder.String()), 0644))
+}
+
+func TestOutputSetUnchanged(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "espy.yaml")
+	env := output.Environment{Fs: afero.NewMemMapFs(), Clock: clock.NewMock(), CrashFunc: func() {}}
+	set := newOutputSet(env, nil)
+
+	writeTestConfig(t, configPath, 100, "same", "/logs/same", "changed", "/logs/changed", "removed", "/logs/removed")
+	conf, err := config.LoadConfig(configPath)
+	require.Nil(t, err)
+	require.Empty(t, set.unchanged(conf), "Nothing should be kept before any outputs are open")
+	first, err := set.open(conf, nil)
+	require.Nil(t, err)
+	require.Equal(t, []string{"same", "changed", "removed"}, outputNames(conf))
+
+	writeTestConfig(t, configPath, 100, "added", "/logs/added", "same", "/logs/same", "changed", "/logs/changed-again")
+	conf, err = config.LoadConfig(configPath)
+	require.Nil(t, err)
+	keep := set.unchanged(conf)
+	require.Equal(t, map[string]bool{"same": true}, keep, "Only outputs with the same settings should be kept")
+
+	// the pipeline closes the outputs which are not kept before opening the rest
+	require.Nil(t, first[1].Close())
+	require.Nil(t, first[2].Close())
+	second, err := set.open(conf, keep)
+	require.Nil(t, err)
+	defer second.Close()
+
+	require.Len(t, second, 3)
+	require.Equal(t, "added", second[0].Name, "Outputs should be returned in the configured order")
+	require.True(t, second[1].Output == first[0].Output, "An unchanged output should keep running")
+	require.False(t, second[2].Output == first[1].Output, "A changed output should be opened again")
+	require.NotContains(t, set.outputs, "removed", "A removed output should be forgotten")
+	require.Len(t, set.configs, 3)
+}
+
+func TestReloadOnHangup(t *testing.T) {
+	logs := test.NewGlobal()
+	defer logs.Reset()
+	defer log.SetLevel(log.GetLevel())
+
+	// keep SIGHUP from stopping the test if it arrives before
+	// reloadOnHangup is listening for it
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+
+	configPath := filepath.Join(t.TempDir(), "espy.yaml")
+	defer func(previous string) { *configFlag = previous }(*configFlag)
+	*configFlag = configPath
+
+	fs := afero.NewMemMapFs()
+	clock := clock.NewMock()
+	clock.Set(time.Date(2022, 02, 14, 16, 17, 18, 0, time.UTC))
+	env := output.Environment{Fs: fs, Clock: clock, CrashFunc: func() {}}
+	set := newOutputSet(env, nil)
+
+	writeTestConfig(t, configPath, 100, "kept", "/logs/kept", "removed", "/logs/removed")
+	conf, err := config.LoadConfig(configPath)
+	require.Nil(t, err)
+	outputs, err := set.open(conf, nil)
+	require.Nil(t, err)
+	router, err := output.NewRouter(conf.S.Routing, outputNames(conf))
+	require.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	source := &idleSource{started: make(chan struct{})}
+	p := pipeline.New(source, outputs, router, conf.S.Pipeline)
+	stopped := make(chan error)
+	go func() { stopped <- p.Run(ctx) }()
+	<-source.started
+	reloaded := make(chan struct{})
+	go func() {
+		defer close(reloaded)
+		reloadOnHangup(ctx, p, set, conf, cancel)
+	}()
+
+	writeTestConfig(t, configPath, 200, "kept", "/logs/kept", "added", "/logs/added")
+	kept := set.outputs["kept"]
+	require.Eventually(t, func() bool {
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		for _, entry := range logs.AllEntries() {
+			if entry.Message == "Configuration reloaded." {
+				return true
+			}
+		}
+		return false
+	}, 5*time.Second, 50*time.Millisecond, "The configuration should be reloaded on SIGHUP")
+
+	cancel()
+	require.Nil(t, <-stopped)
+	<-reloaded
+	require.True(t, set.outputs["kept"] == kept, "An unchanged output should keep running")
+	require.Contains(t, set.outputs, "added")
+	require.NotContains(t, set.outputs, "removed")
+
+	archived, err := afero.Glob(fs, "/logs/removed/2022-02-14/conn.*.log.gz")
+	require.Nil(t, err)
+	require.Len(t, archived, 1, "A removed output should be closed")
+
+	warned := false
+	for _, entry := range logs.AllEntries() {
+		if entry.Level == log.WarnLevel && strings.Contains(entry.Message, "Pipeline settings take effect after espy is restarted") {
+			warned = true
+		}
+	}
+	require.True(t, warned, "Changes which need a restart should be reported")
+}
@@ -99,9 +99,28 @@ EOF
 }
 
 
+# Configuration files from before the Docker health check have no Monitoring
+# section, which leaves the health check without a listener to query
+ensure_monitoring_listener () {
+    if $SUDO grep -q '^Monitoring:' "$ESPY_CONFIG_DIR/espy.yaml"; then
+        return
+    fi
+
+    echo2 "Enabling the Espy health check listener in $ESPY_CONFIG_DIR/espy.yaml"
+    cat << EOF | $SUDO tee -a "$ESPY_CONFIG_DIR/espy.yaml" > /dev/null
+
+# Monitoring
+# Serves Prometheus metrics at /metrics and the health checks used by
+# "espy -healthcheck" at /healthz and /readyz
+Monitoring:
+  Listen: ":9109"
+EOF
+}
+
 ensure_config_files_exist () {
     # both espy and redis config files already exist
     if [ -f "$ESPY_CONFIG_DIR/espy.yaml" -a -f "$ESPY_CONFIG_DIR/redis.conf" ]; then
+        ensure_monitoring_listener
         return
     fi
 